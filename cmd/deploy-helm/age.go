@@ -1,25 +1,192 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
 )
 
 const (
-	// ageKeyFilePath is the path where to store the age-key-secret openshift secret content,
-	// required by the helm secrets plugin.
-	ageKeyFilePath = "./key.txt"
+	ageKeygenBin = "age-keygen"
+	// ageKeySecretAllFields is the field name which selects all fields of
+	// an age key secret.
+	ageKeySecretAllFields = "*"
 )
 
-func storeAgeKey(ageKeyContent []byte) error {
-	file, err := os.Create(ageKeyFilePath)
+// ageKeyProvider imports an age key from a K8s secret.
+type ageKeyProvider struct {
+	// Name of age-keygen binary, defaults to ageKeygenBin.
+	keygenBin string
+}
+
+func (p *ageKeyProvider) name() string {
+	return "age"
+}
+
+func (p *ageKeyProvider) configured(opts options) bool {
+	return len(opts.ageKeySecret) > 0 || len(opts.ageKeySecretsPerNamespace) > 0
+}
+
+func (p *ageKeyProvider) importKey(d *deployHelm) ([]string, bool, error) {
+	secretNames, err := ageKeySecrets(d.opts, d.releaseNamespace)
+	if err != nil {
+		return nil, false, err
+	}
+	keygenBin := p.keygenBin
+	if keygenBin == "" {
+		keygenBin = ageKeygenBin
+	}
+	var identities []byte
+	var recipients []string
+	for _, secretName := range secretNames {
+		secret, err := d.keySecret(secretName)
+		if err != nil {
+			return nil, false, fmt.Errorf("get secret %s: %w", secretName, err)
+		}
+		if secret == nil {
+			d.logger.Infof("No secret %q found in namespace %q, skipping.", secretName, d.ctxt.Namespace)
+			continue
+		}
+		fields := []string{d.opts.ageKeySecretField}
+		if d.opts.ageKeySecretField == ageKeySecretAllFields {
+			fields = sortedKeys(secret.Data)
+		}
+		for _, field := range fields {
+			ageKeyContent := secret.Data[field]
+			if !bytes.HasSuffix(ageKeyContent, []byte("\n")) {
+				ageKeyContent = append(append([]byte{}, ageKeyContent...), '\n')
+			}
+			lines := ageIdentityLines(ageKeyContent)
+			if len(lines) == 0 {
+				return nil, false, fmt.Errorf("field %s of secret %s: no age identity found", field, secretName)
+			}
+			d.redactor.Add(string(ageKeyContent))
+			d.redactor.Add(lines...)
+			// age-keygen fails on malformed identities, which validates them.
+			fieldRecipients, err := d.ageKeyRecipients(keygenBin, ageKeyContent)
+			if err != nil {
+				return nil, false, fmt.Errorf("field %s of secret %s is not a valid age identity file: %s", field, secretName, d.redactor.String(err.Error()))
+			}
+			recipients = append(recipients, fieldRecipients...)
+			identities = append(identities, ageKeyContent...)
+			d.logger.Infof("Age key from field %s of secret %s added.", field, secretName)
+		}
+	}
+	if len(identities) == 0 {
+		return nil, false, nil
+	}
+	ageKeyFile, err := storeAgeKey(identities)
+	if ageKeyFile != "" {
+		d.addCleanup(func() {
+			if err := os.Remove(ageKeyFile); err != nil && !os.IsNotExist(err) {
+				d.logger.Warnf("Could not remove age key file: %s", err)
+			}
+		})
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("store age key: %w", err)
+	}
+	d.logger.Infof("Age keys stored.")
+	d.importedKeys.ageRecipients = append(d.importedKeys.ageRecipients, recipients...)
+	return []string{fmt.Sprintf("SOPS_AGE_KEY_FILE=%s", ageKeyFile)}, true, nil
+}
+
+// ageKeyRecipients returns the recipients (public keys) of the identities
+// in ageKeyContent, which is stored in a private temporary file for
+// age-keygen to read.
+func (d *deployHelm) ageKeyRecipients(keygenBin string, ageKeyContent []byte) ([]string, error) {
+	ageKeyFile, err := storeAgeKey(ageKeyContent)
+	if ageKeyFile != "" {
+		defer func() {
+			if err := os.Remove(ageKeyFile); err != nil && !os.IsNotExist(err) {
+				d.logger.Warnf("Could not remove age key file: %s", err)
+			}
+		}()
+	}
 	if err != nil {
-		return fmt.Errorf("create age key file path: %w", err)
+		return nil, fmt.Errorf("store age key: %w", err)
+	}
+	return ageRecipients(keygenBin, ageKeyFile)
+}
+
+// ageRecipients returns the recipients (public keys) of the identities
+// stored in ageKeyFile.
+func ageRecipients(keygenBin, ageKeyFile string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	err := command.RunRaw(keygenBin, []string{"-y", ageKeyFile}, []string{}, &stdout, &stderr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+// ageKeySecrets returns the names of the secrets holding the age keys to
+// use for the target namespace. Secrets configured for the target namespace
+// specifically take precedence over the generally configured secrets.
+func ageKeySecrets(opts options, namespace string) ([]string, error) {
+	perNamespace, err := parseAgeKeySecretsPerNamespace(opts.ageKeySecretsPerNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("parse age key secrets per namespace: %w", err)
+	}
+	if secrets, ok := perNamespace[namespace]; ok {
+		return secrets, nil
+	}
+	return splitList(opts.ageKeySecret), nil
+}
+
+// parseAgeKeySecretsPerNamespace parses whitespace separated entries of the
+// form "namespace=secret[,secret...]".
+func parseAgeKeySecretsPerNamespace(s string) (map[string][]string, error) {
+	m := map[string][]string{}
+	for _, entry := range strings.Fields(s) {
+		namespace, secrets, found := strings.Cut(entry, "=")
+		if !found || namespace == "" {
+			return nil, fmt.Errorf("entry %q must be of the form namespace=secret[,secret...]", entry)
+		}
+		secretNames := splitList(secrets)
+		if len(secretNames) == 0 {
+			return nil, fmt.Errorf("entry %q does not name any secret", entry)
+		}
+		m[namespace] = append(m[namespace], secretNames...)
+	}
+	return m, nil
+}
+
+// storeAgeKey writes the age key into a new file in the temporary directory
+// which is only accessible by the current user. The name of the file is
+// returned, also if writing the key fails.
+func storeAgeKey(ageKeyContent []byte) (string, error) {
+	file, err := os.CreateTemp("", "age-key-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("create age key file: %w", err)
 	}
 	defer file.Close()
+	err = file.Chmod(0600)
+	if err != nil {
+		return file.Name(), fmt.Errorf("restrict permissions of age key file: %w", err)
+	}
 	_, err = file.Write(ageKeyContent)
 	if err != nil {
-		return fmt.Errorf("write age key: %w", err)
+		return file.Name(), fmt.Errorf("write age key: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// ageIdentityLines returns the lines of an age identity file which are
+// neither empty nor comments (starting with #).
+func ageIdentityLines(content []byte) []string {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
 	}
-	return err
+	return lines
 }
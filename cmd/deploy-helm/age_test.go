@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testAgeIdentity     = "AGE-SECRET-KEY-1N7RDPQVGF37KTX30A2SV2KKSZK3M7NCM9V9CYTX3T4KPTV8SPGYQJ82XWM"
+	testAgeIdentityQA   = "AGE-SECRET-KEY-18UL00P4NF4KAW9HPSYKGKA985RSLQK497V3STZ8K7K7DQRRVSWFQ9NDKA7"
+	testAgeIdentityProd = "AGE-SECRET-KEY-1VA22L93J5F69APWZJ0J64SYXXDCDN0FNXZUE8RQQET0AY9FZ04MSTFVPJE"
+)
+
+func TestAgeKeyProviderValidatesKeys(t *testing.T) {
+	// Fake age-keygen binary rejecting the identity, echoing it like
+	// age-keygen does in some error messages.
+	failingKeygen := filepath.Join(t.TempDir(), "age-keygen")
+	err := os.WriteFile(failingKeygen, []byte("#!/bin/sh\necho \"malformed secret key: $(grep -v '^#' \"$2\")\" >&2\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		content   string
+		keygenBin string
+		wantErr   string
+	}{
+		"empty content": {
+			content: "",
+			wantErr: "field key.txt of secret keys: no age identity found",
+		},
+		"only comments": {
+			content: "# public key: age1xyz\n",
+			wantErr: "field key.txt of secret keys: no age identity found",
+		},
+		"rejected by age-keygen": {
+			content:   "# public key: age1xyz\n" + testAgeIdentity + "\n",
+			keygenBin: failingKeygen,
+			wantErr:   "field key.txt of secret keys is not a valid age identity file: exit status 1: malformed secret key: ***",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "keys", Namespace: "foo-cd"},
+				Data:       map[string][]byte{"key.txt": []byte(tc.content)},
+			})
+			d := &deployHelm{
+				logger:    testLogger(),
+				clientset: clientset,
+				ctxt:      &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+				redactor:  redact.New(),
+				opts:      options{ageKeySecret: "keys", ageKeySecretField: "key.txt"},
+			}
+			defer d.cleanup()
+			keygenBin := tc.keygenBin
+			if keygenBin == "" {
+				keygenBin = "../../test/scripts/age-keygen.sh"
+			}
+			_, _, err := (&ageKeyProvider{keygenBin: keygenBin}).importKey(d)
+			if err == nil {
+				t.Fatal("want err, got none")
+			}
+			if diff := cmp.Diff(tc.wantErr, err.Error()); diff != "" {
+				t.Fatalf("error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAgeKeySecrets(t *testing.T) {
+	tests := map[string]struct {
+		opts      options
+		namespace string
+		want      []string
+		wantErr   bool
+	}{
+		"single secret": {
+			opts:      options{ageKeySecret: "helm-secrets-age-key"},
+			namespace: "foo-dev",
+			want:      []string{"helm-secrets-age-key"},
+		},
+		"list of secrets": {
+			opts:      options{ageKeySecret: "a, b,,c"},
+			namespace: "foo-dev",
+			want:      []string{"a", "b", "c"},
+		},
+		"namespace without specific secrets": {
+			opts: options{
+				ageKeySecret:              "helm-secrets-age-key",
+				ageKeySecretsPerNamespace: "foo-qa=qa-key foo-prod=prod-key",
+			},
+			namespace: "foo-dev",
+			want:      []string{"helm-secrets-age-key"},
+		},
+		"namespace with specific secrets": {
+			opts: options{
+				ageKeySecret:              "helm-secrets-age-key",
+				ageKeySecretsPerNamespace: "foo-qa=qa-key\nfoo-prod=prod-key,shared-key",
+			},
+			namespace: "foo-prod",
+			want:      []string{"prod-key", "shared-key"},
+		},
+		"malformed entry": {
+			opts:      options{ageKeySecretsPerNamespace: "foo-qa"},
+			namespace: "foo-qa",
+			wantErr:   true,
+		},
+		"entry without secret": {
+			opts:      options{ageKeySecretsPerNamespace: "foo-qa=,"},
+			namespace: "foo-qa",
+			wantErr:   true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ageKeySecrets(tc.opts, tc.namespace)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("secrets mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAgeKeyProviderCombinesKeys(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qa-keys", Namespace: "foo-cd"},
+			Data: map[string][]byte{
+				"a.txt": []byte(testAgeIdentity + "\n"),
+				"b.txt": []byte(testAgeIdentityQA),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prod-keys", Namespace: "foo-cd"},
+			Data:       map[string][]byte{"a.txt": []byte(testAgeIdentityProd)},
+		},
+	)
+	d := &deployHelm{
+		logger:           testLogger(),
+		clientset:        clientset,
+		ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+		releaseNamespace: "foo-qa",
+		opts: options{
+			ageKeySecret:              "missing",
+			ageKeySecretField:         ageKeySecretAllFields,
+			ageKeySecretsPerNamespace: "foo-qa=qa-keys,missing foo-prod=prod-keys",
+		},
+	}
+	defer d.cleanup()
+	env, imported, err := (&ageKeyProvider{keygenBin: "../../test/scripts/age-keygen.sh"}).importKey(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imported || len(env) != 1 {
+		t.Fatalf("want one env var, got %v", env)
+	}
+	content, err := os.ReadFile(strings.TrimPrefix(env[0], "SOPS_AGE_KEY_FILE="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testAgeIdentity + "\n" + testAgeIdentityQA + "\n"
+	if diff := cmp.Diff(want, string(content)); diff != "" {
+		t.Fatalf("identities mismatch (-want +got):\n%s", diff)
+	}
+	// The fake age-keygen numbers the recipients of each field separately.
+	wantRecipients := []string{"age1fakerecipient1", "age1fakerecipient1"}
+	if diff := cmp.Diff(wantRecipients, d.importedKeys.ageRecipients); diff != "" {
+		t.Fatalf("recipients mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStoreAgeKey(t *testing.T) {
+	ageKeyFile, err := storeAgeKey([]byte(testAgeIdentity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ageKeyFile)
+	fi, err := os.Stat(ageKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("want permissions 0600, got %o", fi.Mode().Perm())
+	}
+	content, err := os.ReadFile(ageKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testAgeIdentity {
+		t.Fatalf("want: %s, got: %s", testAgeIdentity, content)
+	}
+}
+
+func TestRunStepsCleansUp(t *testing.T) {
+	failing := func(d *deployHelm) (*deployHelm, error) {
+		return d, errors.New("failed")
+	}
+	skipping := func(d *deployHelm) (*deployHelm, error) {
+		return d, &skipRemainingSteps{"skipped"}
+	}
+	for name, lastStep := range map[string]DeployStep{"on error": failing, "on skip": skipping} {
+		t.Run(name, func(t *testing.T) {
+			cleanedUp := false
+			d := &deployHelm{logger: testLogger()}
+			_ = d.runSteps(
+				func(d *deployHelm) (*deployHelm, error) {
+					d.addCleanup(func() { cleanedUp = true })
+					return d, nil
+				},
+				lastStep,
+			)
+			if !cleanedUp {
+				t.Fatal("want cleanup to run")
+			}
+		})
+	}
+}
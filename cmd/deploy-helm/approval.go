@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// approvalConfigMapPrefix is the prefix of the ConfigMap used to approve a diff.
+	approvalConfigMapPrefix = "ods-helm-approval"
+	// approvalKey is the ConfigMap data key holding the approval decision.
+	approvalKey = "approved"
+	// approvalDiffKey is the ConfigMap data key holding the checksum of the diff to approve.
+	approvalDiffKey = "diff-sha256"
+	// Values of approvalKey.
+	approvalPending  = "pending"
+	approvalGranted  = "true"
+	approvalRejected = "false"
+	// approvalPollInterval is the interval in which the approval is checked.
+	approvalPollInterval = 5 * time.Second
+)
+
+// approvalConfigMapName returns the name of the ConfigMap used to approve
+// the diff of given release.
+func approvalConfigMapName(releaseName, releaseNamespace string) string {
+	return releaseConfigMapName(approvalConfigMapPrefix, releaseName, releaseNamespace)
+}
+
+// diffChecksum returns the SHA256 checksum of given diff.
+func diffChecksum(diff []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(diff))
+}
+
+// requestApproval creates (or resets) the approval ConfigMap in the pipeline
+// namespace and waits until the diff is approved or rejected, or the
+// timeout is exceeded.
+func (d *deployHelm) requestApproval(diff []byte, interval, timeout time.Duration) error {
+	ctx := context.TODO()
+	configMaps := d.clientset.CoreV1().ConfigMaps(d.ctxt.Namespace)
+	checksum := diffChecksum(diff)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: approvalConfigMapName(d.releaseName, d.releaseNamespace),
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "ods-pipeline-helm",
+			},
+		},
+		Data: map[string]string{
+			"release":       d.releaseName,
+			"namespace":     d.releaseNamespace,
+			approvalDiffKey: checksum,
+			approvalKey:     approvalPending,
+		},
+	}
+	_, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("create approval ConfigMap %s: %w", cm.Name, err)
+	}
+	d.addCleanup(func() {
+		err := configMaps.Delete(context.TODO(), cm.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			d.logger.Warnf("Could not delete approval ConfigMap %s: %s", cm.Name, err)
+		}
+	})
+
+	d.logger.Infof(
+		"Waiting up to %s for approval of the diff (sha256 %s). To approve, run:\n"+
+			"  kubectl -n %s patch configmap %s --type merge -p '{\"data\":{\"%s\":\"%s\"}}'\n"+
+			"To reject, set %q to %q instead.",
+		timeout, checksum, d.ctxt.Namespace, cm.Name, approvalKey, approvalGranted, approvalKey, approvalRejected,
+	)
+	var rejected bool
+	err = wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		current, err := configMaps.Get(ctx, cm.Name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, fmt.Errorf("approval ConfigMap %s has been deleted", cm.Name)
+			}
+			d.logger.Warnf("Could not get approval ConfigMap %s: %s", cm.Name, err)
+			return false, nil
+		}
+		if current.Data[approvalDiffKey] != checksum {
+			return false, fmt.Errorf("diff checksum in approval ConfigMap %s has been modified", cm.Name)
+		}
+		switch current.Data[approvalKey] {
+		case approvalGranted:
+			return true, nil
+		case approvalRejected:
+			rejected = true
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return fmt.Errorf("diff has not been approved within %s", timeout)
+		}
+		return err
+	}
+	if rejected {
+		return errors.New("diff has been rejected")
+	}
+	d.logger.Infof("Diff has been approved.")
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRequestApproval(t *testing.T) {
+	tests := map[string]struct {
+		decision string
+		wantErr  bool
+	}{
+		"approved": {
+			decision: approvalGranted,
+			wantErr:  false,
+		},
+		"rejected": {
+			decision: approvalRejected,
+			wantErr:  true,
+		},
+		"timed out": {
+			decision: "",
+			wantErr:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			d := &deployHelm{
+				logger:           testLogger(),
+				clientset:        clientset,
+				ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+				releaseName:      "bar",
+				releaseNamespace: "foo-prod",
+			}
+			cmName := approvalConfigMapName(d.releaseName, d.releaseNamespace)
+			if tc.decision != "" {
+				go func() {
+					configMaps := clientset.CoreV1().ConfigMaps("foo-cd")
+					for {
+						cm, err := configMaps.Get(context.TODO(), cmName, metav1.GetOptions{})
+						if err == nil {
+							cm.Data[approvalKey] = tc.decision
+							_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+							if err == nil {
+								return
+							}
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}()
+			}
+			err := d.requestApproval([]byte("some diff"), 10*time.Millisecond, 500*time.Millisecond)
+			if tc.wantErr && err == nil {
+				t.Fatal("want err, got none")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			d.cleanup()
+			_, err = clientset.CoreV1().ConfigMaps("foo-cd").Get(context.TODO(), cmName, metav1.GetOptions{})
+			if err == nil {
+				t.Fatal("want approval ConfigMap to be deleted")
+			}
+		})
+	}
+}
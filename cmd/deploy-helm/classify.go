@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// changeClass categorizes the risk of changes detected by helm-diff.
+// Classes are ordered by risk, the lowest risk coming first.
+type changeClass int
+
+const (
+	changeClassNone changeClass = iota
+	changeClassImageOnly
+	changeClassScaling
+	changeClassConfig
+	changeClassCRD
+	changeClassDestructive
+)
+
+var changeClassNames = []string{"none", "image-only", "scaling", "config", "crd-change", "destructive"}
+
+const (
+	// Actions to take when destructive changes are detected.
+	destructiveChangeAllow = "allow"
+	destructiveChangeStop  = "stop"
+	destructiveChangeFail  = "fail"
+)
+
+// diffHeaderPattern matches the line helm-diff prints before the diff of a
+// resource, e.g. "foo-dev, bar, Deployment (apps) has changed:".
+var diffHeaderPattern = regexp.MustCompile(`^(\S*), (\S+), (\S+) \((\S+)\) has (been added|been removed|changed):$`)
+
+// diffNoisePrefixes identifies changed lines which are expected to change
+// with every deployment (because chart version and app version are set
+// to the Git commit SHA) and therefore do not influence the class.
+var diffNoisePrefixes = []string{"helm.sh/chart:", "app.kubernetes.io/version:", "# Source:"}
+
+func (c changeClass) String() string {
+	if c < 0 || int(c) >= len(changeClassNames) {
+		return fmt.Sprintf("changeClass(%d)", int(c))
+	}
+	return changeClassNames[c]
+}
+
+// parseChangeClass returns the class with given name.
+func parseChangeClass(s string) (changeClass, error) {
+	for i, name := range changeClassNames {
+		if name == s {
+			return changeClass(i), nil
+		}
+	}
+	return changeClassNone, fmt.Errorf("unknown change class %q, must be one of: %s", s, strings.Join(changeClassNames, ", "))
+}
+
+// resourceChange describes the change of one resource detected by helm-diff.
+type resourceChange struct {
+	Namespace string
+	Name      string
+	Kind      string
+	// Change is one of "been added", "been removed" or "changed".
+	Change string
+	Class  changeClass
+}
+
+func (rc resourceChange) String() string {
+	return fmt.Sprintf("%s/%s has %s (%s)", rc.Kind, rc.Name, rc.Change, rc.Class)
+}
+
+// classifyDiff classifies each resource change in the helm-diff output.
+func classifyDiff(diff string) []resourceChange {
+	changes := []resourceChange{}
+	var current *resourceChange
+	var changedLines []string
+	finish := func() {
+		if current != nil {
+			current.Class = classifyResourceChange(*current, changedLines)
+			changes = append(changes, *current)
+		}
+	}
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(diff)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := diffHeaderPattern.FindStringSubmatch(line); m != nil {
+			finish()
+			current = &resourceChange{Namespace: m[1], Name: m[2], Kind: m[3], Change: m[5]}
+			changedLines = []string{}
+			continue
+		}
+		if current == nil || !(strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")) {
+			continue
+		}
+		changed := strings.TrimPrefix(strings.TrimSpace(line[1:]), "- ")
+		if changed == "" || hasAnyPrefix(changed, diffNoisePrefixes) {
+			continue
+		}
+		changedLines = append(changedLines, changed)
+	}
+	finish()
+	return changes
+}
+
+// classifyResourceChange determines the class of a single resource change
+// given the lines changed within the resource.
+func classifyResourceChange(rc resourceChange, changedLines []string) changeClass {
+	if rc.Change == "been removed" {
+		return changeClassDestructive
+	}
+	if rc.Kind == "CustomResourceDefinition" {
+		return changeClassCRD
+	}
+	if rc.Change == "been added" {
+		return changeClassConfig
+	}
+	class := changeClassImageOnly
+	for _, l := range changedLines {
+		switch {
+		case rc.Kind == "Service" && strings.HasPrefix(l, "type:"):
+			return changeClassDestructive
+		case strings.HasPrefix(l, "image:"):
+			// image-only
+		case strings.HasPrefix(l, "replicas:"):
+			if class < changeClassScaling {
+				class = changeClassScaling
+			}
+		default:
+			class = changeClassConfig
+		}
+	}
+	return class
+}
+
+// highestChangeClass returns the class of the riskiest change.
+func highestChangeClass(changes []resourceChange) changeClass {
+	class := changeClassNone
+	for _, c := range changes {
+		if c.Class > class {
+			class = c.Class
+		}
+	}
+	return class
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassifyDiff(t *testing.T) {
+	tests := map[string]struct {
+		diff      string
+		want      []changeClass
+		wantClass changeClass
+	}{
+		"no changes": {
+			diff:      "",
+			want:      []changeClass{},
+			wantClass: changeClassNone,
+		},
+		"image bump": {
+			diff: `foo-dev, foo, Deployment (apps) has changed:
+  # Source: foo/templates/deployment.yaml
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    labels:
+-     app.kubernetes.io/version: abc
++     app.kubernetes.io/version: def
+-     helm.sh/chart: foo-0.1.0_abc
++     helm.sh/chart: foo-0.1.0_def
+  spec:
+    template:
+      spec:
+        containers:
+-       - image: registry/foo/foo:abc
++       - image: registry/foo/foo:def
+          name: foo
+foo-dev, foo, Service (v1) has changed:
+  # Source: foo/templates/service.yaml
+  metadata:
+    labels:
+-     helm.sh/chart: foo-0.1.0_abc
++     helm.sh/chart: foo-0.1.0_def
+`,
+			want:      []changeClass{changeClassImageOnly, changeClassImageOnly},
+			wantClass: changeClassImageOnly,
+		},
+		"scaling": {
+			diff: `foo-dev, foo, Deployment (apps) has changed:
+  spec:
+-   replicas: 1
++   replicas: 3
+        containers:
+-       - image: registry/foo/foo:abc
++       - image: registry/foo/foo:def
+`,
+			want:      []changeClass{changeClassScaling},
+			wantClass: changeClassScaling,
+		},
+		"config": {
+			diff: `foo-dev, foo, ConfigMap (v1) has changed:
+  data:
+-   LOG_LEVEL: info
++   LOG_LEVEL: debug
+foo-dev, bar, Deployment (apps) has changed:
+-   replicas: 1
++   replicas: 2
+foo-dev, baz, Route (route.openshift.io) has been added:
++ apiVersion: route.openshift.io/v1
+`,
+			want:      []changeClass{changeClassConfig, changeClassScaling, changeClassConfig},
+			wantClass: changeClassConfig,
+		},
+		"CRD change": {
+			diff: `, foos.example.com, CustomResourceDefinition (apiextensions.k8s.io) has changed:
+-       type: string
++       type: integer
+`,
+			want:      []changeClass{changeClassCRD},
+			wantClass: changeClassCRD,
+		},
+		"service type change": {
+			diff: `foo-dev, foo, Service (v1) has changed:
+  spec:
+-   type: ClusterIP
++   type: LoadBalancer
+`,
+			want:      []changeClass{changeClassDestructive},
+			wantClass: changeClassDestructive,
+		},
+		"deletion": {
+			diff: `foo-dev, data, PersistentVolumeClaim (v1) has been removed:
+- apiVersion: v1
+- kind: PersistentVolumeClaim
+foo-dev, foo, Deployment (apps) has changed:
+-       - image: registry/foo/foo:abc
++       - image: registry/foo/foo:def
+`,
+			want:      []changeClass{changeClassDestructive, changeClassImageOnly},
+			wantClass: changeClassDestructive,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			changes := classifyDiff(tc.diff)
+			got := []changeClass{}
+			for _, c := range changes {
+				got = append(got, c.Class)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("classes mismatch (-want +got):\n%s", diff)
+			}
+			if gotClass := highestChangeClass(changes); gotClass != tc.wantClass {
+				t.Fatalf("want class %s, got %s", tc.wantClass, gotClass)
+			}
+		})
+	}
+}
+
+func TestParseChangeClass(t *testing.T) {
+	for _, name := range changeClassNames {
+		c, err := parseChangeClass(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.String() != name {
+			t.Fatalf("want %s, got %s", name, c)
+		}
+	}
+	if _, err := parseChangeClass("unknown"); err == nil {
+		t.Fatal("want err, got none")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// subcommand of deploy-helm. Each subcommand has its own flags and runs a
+// sequence of DeployStep.
+type subcommand struct {
+	name string
+	// Short description shown in the help text.
+	description string
+	// Functions registering the flags of the subcommand.
+	flags []func(fs *flag.FlagSet, opts *options)
+	// setup adjusts the parsed options before the steps run.
+	setup func(opts *options)
+	// steps returns the steps to run.
+	steps func(opts options) []DeployStep
+}
+
+// defaultSubcommand is run when deploy-helm is invoked without a subcommand.
+const defaultSubcommand = "deploy"
+
+var subcommands = []subcommand{
+	{
+		name:        "deploy",
+		description: "Diff, promote images and upgrade the Helm release (default)",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerKeyFlags, registerChartFlags, registerRegistryFlags, registerDeployFlags, registerTeardownFlags, registerPreviewFlags, registerNamespaceFlags, registerLockFlags,
+		},
+		steps: deploySteps,
+	},
+	{
+		name:        "diff",
+		description: "Diff the chart against the Helm release without upgrading it",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerKeyFlags, registerChartFlags, registerDiffFlags,
+		},
+		setup: func(opts *options) { opts.diffOnly = true },
+		steps: deploySteps,
+	},
+	{
+		name:        "promote",
+		description: "Copy the images built for the checked out commit into the release namespace",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerRegistryFlags, registerPromoteFlags,
+		},
+		steps: promoteSteps,
+	},
+	{
+		name:        "status",
+		description: "Gather the status of the Helm release and its workloads",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerRevisionResultFlags,
+		},
+		setup: func(opts *options) { opts.gatherStatus = true },
+		steps: statusSteps,
+	},
+	{
+		name:        "rollback",
+		description: "Roll the Helm release back to a previous revision",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerRevisionResultFlags, registerRollbackFlags, registerLockFlags,
+		},
+		steps: rollbackSteps,
+	},
+	{
+		name:        "uninstall",
+		description: "Uninstall the Helm release, optionally deleting its promoted images and namespace",
+		flags: []func(fs *flag.FlagSet, opts *options){
+			registerCommonFlags, registerRegistryFlags, registerUninstallFlags, registerTeardownFlags, registerLockFlags,
+		},
+		steps: teardownSteps,
+	},
+}
+
+// parseArgs selects the subcommand given as first argument and parses the
+// remaining arguments with its flags. Without a subcommand, the arguments
+// are parsed as flags of the default subcommand. Errors and help texts are
+// written to output.
+func parseArgs(args []string, output io.Writer) (*subcommand, options, error) {
+	cmd := findSubcommand(defaultSubcommand)
+	if len(args) > 0 {
+		if c := findSubcommand(args[0]); c != nil {
+			cmd = c
+			args = args[1:]
+		} else if len(args[0]) > 0 && args[0][0] != '-' {
+			fmt.Fprintf(output, "unknown subcommand %q\n", args[0])
+			printSubcommands(output)
+			return nil, options{}, fmt.Errorf("unknown subcommand %q", args[0])
+		}
+	}
+	// Options without a flag in the subcommand keep their defaults.
+	opts := defaultOptions
+	fs := flag.NewFlagSet("deploy-helm "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	for _, register := range cmd.flags {
+		register(fs, &opts)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage: deploy-helm %s [flags]\n\n%s.\n\n", cmd.name, cmd.description)
+		if cmd.name == defaultSubcommand {
+			printSubcommands(output)
+		}
+		fmt.Fprintln(output, "Flags:")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, options{}, err
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(output, "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return nil, options{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if cmd.setup != nil {
+		cmd.setup(&opts)
+	}
+	return cmd, opts, nil
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+func printSubcommands(output io.Writer) {
+	fmt.Fprintln(output, "Subcommands:")
+	for _, c := range subcommands {
+		fmt.Fprintf(output, "  %-10s %s\n", c.name, c.description)
+	}
+	fmt.Fprintln(output)
+}
+
+// registerCommonFlags registers the flags selecting the release and the
+// cluster, which all subcommands share.
+func registerCommonFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.checkoutDir, "checkout-dir", defaultOptions.checkoutDir, "Checkout dir")
+	fs.StringVar(&opts.chartDir, "chart-dir", defaultOptions.chartDir, "Chart dir")
+	fs.StringVar(&opts.releaseName, "release-name", defaultOptions.releaseName, "Name of Helm release")
+	fs.StringVar(&opts.apiServer, "api-server", defaultOptions.apiServer, "API server of the target cluster, including scheme")
+	fs.StringVar(&opts.apiCredentialsSecret, "api-credentials-secret", defaultOptions.apiCredentialsSecret, "Name of the Secret resource holding the API user credentials")
+	fs.BoolVar(&opts.apiInsecureSkipTLSVerify, "api-insecure-skip-tls-verify", defaultOptions.apiInsecureSkipTLSVerify, "Whether to skip TLS verification of the API server of the target cluster (insecure)")
+	fs.StringVar(&opts.namespace, "namespace", defaultOptions.namespace, "Target K8s namespace (or OpenShift project) to deploy into")
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", defaultOptions.kubeconfig, "Path of the kubeconfig file used outside of the cluster (defaults to $KUBECONFIG or ~/.kube/config)")
+	fs.StringVar(&opts.kubeContext, "kube-context", defaultOptions.kubeContext, "Context of the kubeconfig to use")
+	fs.StringVar(&opts.pipelineNamespace, "pipeline-namespace", defaultOptions.pipelineNamespace, "Namespace the pipeline runs in (defaults to the namespace of the ODS context or of the kubeconfig context)")
+	fs.StringVar(&opts.releaseNamespaceResultPath, "release-namespace-result-path", defaultOptions.releaseNamespaceResultPath, "Path of the Tekton result file to write the release namespace to")
+	fs.BoolVar(&opts.debug, "debug", defaultOptions.debug, "debug mode")
+}
+
+// registerKeyFlags registers the flags selecting the keys to decrypt secrets.
+func registerKeyFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.ageKeySecret, "age-key-secret", defaultOptions.ageKeySecret, "Comma separated names of the secrets containing the age keys to use for helm-secrets")
+	fs.StringVar(&opts.ageKeySecretField, "age-key-secret-field", defaultOptions.ageKeySecretField, "Name of the field in the secrets holding the age private key (use * for all fields)")
+	fs.StringVar(&opts.ageKeySecretsPerNamespace, "age-key-secrets-per-namespace", defaultOptions.ageKeySecretsPerNamespace, "Whitespace separated entries of the form namespace=secret[,secret...] selecting the age key secrets per target namespace")
+	fs.StringVar(&opts.pgpKeySecret, "pgp-key-secret", defaultOptions.pgpKeySecret, "Name of the secret containing the PGP private key to use for helm-secrets")
+	fs.StringVar(&opts.pgpKeySecretField, "pgp-key-secret-field", defaultOptions.pgpKeySecretField, "Name of the field in the secret holding the armored PGP private key")
+	fs.StringVar(&opts.vaultTokenSecret, "vault-token-secret", defaultOptions.vaultTokenSecret, "Name of the secret containing the Vault token to use for helm-secrets")
+	fs.StringVar(&opts.vaultTokenSecretField, "vault-token-secret-field", defaultOptions.vaultTokenSecretField, "Name of the field in the secret holding the Vault token")
+	fs.StringVar(&opts.vaultAddr, "vault-addr", defaultOptions.vaultAddr, "Address of the Vault server, including scheme")
+}
+
+// registerChartFlags registers the flags passed to Helm when diffing and
+// upgrading the chart.
+func registerChartFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.diffFlags, "diff-flags", defaultOptions.diffFlags, "Flags to pass to `helm diff upgrade` (in addition to default ones and upgrade flags)")
+	fs.StringVar(&opts.upgradeFlags, "upgrade-flags", defaultOptions.upgradeFlags, "Flags to pass to `helm upgrade`")
+}
+
+// registerRegistryFlags registers the flags configuring access to the registries.
+func registerRegistryFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.registryHost, "registry-host", defaultOptions.registryHost, "Hostname of the target registry to push images to")
+	fs.StringVar(&opts.certDir, "cert-dir", defaultOptions.certDir, "Use certificates at the specified path to access the registry")
+	fs.BoolVar(&opts.srcRegistryTLSVerify, "src-registry-tls-verify", defaultOptions.srcRegistryTLSVerify, "TLS verify source registry")
+}
+
+// registerDiffFlags registers the flags of the diff which are not already
+// registered by registerDeployFlags.
+func registerDiffFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.changeClassResultPath, "change-class-result-path", defaultOptions.changeClassResultPath, "Path of the Tekton result file to write the change class to")
+}
+
+// registerPromoteFlags registers the flags of the promote subcommand.
+func registerPromoteFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.imagesPromotedResultPath, "images-promoted-result-path", defaultOptions.imagesPromotedResultPath, "Path of the Tekton result file to write whether images were promoted to")
+}
+
+// registerRevisionResultFlags registers the flags of results describing
+// the current revision of the release.
+func registerRevisionResultFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.revisionResultPath, "revision-result-path", defaultOptions.revisionResultPath, "Path of the Tekton result file to write the release revision to")
+	fs.StringVar(&opts.statusResultPath, "status-result-path", defaultOptions.statusResultPath, "Path of the Tekton result file to write the release status to")
+}
+
+// registerRollbackFlags registers the flags of the rollback subcommand.
+func registerRollbackFlags(fs *flag.FlagSet, opts *options) {
+	fs.IntVar(&opts.rollbackRevision, "revision", defaultOptions.rollbackRevision, "Revision to roll back to (0 rolls back to the previous revision)")
+	fs.StringVar(&opts.rollbackFlags, "rollback-flags", defaultOptions.rollbackFlags, "Flags to pass to `helm rollback`")
+}
+
+// registerUninstallFlags registers the flags of the uninstall subcommand.
+func registerUninstallFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.uninstallFlags, "uninstall-flags", defaultOptions.uninstallFlags, "Flags to pass to `helm uninstall`")
+}
+
+// registerLockFlags registers the flags of the release lock, which is taken
+// by the deploy, rollback and uninstall subcommands.
+func registerLockFlags(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.releaseLock, "release-lock", defaultOptions.releaseLock, "Whether to lock the release (using a Lease in the release namespace) while operating on it")
+	fs.DurationVar(&opts.releaseLockTimeout, "release-lock-timeout", defaultOptions.releaseLockTimeout, "How long to wait for the release lock held by another pipeline run")
+	fs.StringVar(&opts.pipelineRun, "pipeline-run", defaultOptions.pipelineRun, "Name of the pipeline run, recorded as holder of the release lock")
+}
+
+// registerTeardownFlags registers the flags of the teardown, which is run
+// by the uninstall subcommand and in teardown mode of the deploy subcommand.
+func registerTeardownFlags(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.deleteImages, "delete-images", defaultOptions.deleteImages, "Whether to delete the image tags promoted into the release namespace on teardown")
+	fs.BoolVar(&opts.deleteNamespace, "delete-namespace", defaultOptions.deleteNamespace, "Whether to delete the release namespace on teardown")
+	fs.BoolVar(&opts.dryRun, "dry-run", defaultOptions.dryRun, "Whether to only report what the teardown would remove")
+}
+
+// registerNamespaceFlags registers the flags configuring the release namespace.
+func registerNamespaceFlags(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.ensureNamespace, "ensure-namespace", defaultOptions.ensureNamespace, "Whether to create the release namespace if it does not exist, and apply the namespace labels, annotations, quota, limit range and image puller binding")
+	fs.StringVar(&opts.namespaceLabels, "namespace-labels", defaultOptions.namespaceLabels, "Whitespace separated entries of the form key=value to set as labels of the release namespace")
+	fs.StringVar(&opts.namespaceAnnotations, "namespace-annotations", defaultOptions.namespaceAnnotations, "Whitespace separated entries of the form key=value to set as annotations of the release namespace")
+	fs.StringVar(&opts.resourceQuotaFile, "resource-quota-file", defaultOptions.resourceQuotaFile, "File holding a ResourceQuota to apply to the release namespace")
+	fs.StringVar(&opts.limitRangeFile, "limit-range-file", defaultOptions.limitRangeFile, "File holding a LimitRange to apply to the release namespace")
+	fs.StringVar(&opts.imagePullerClusterRole, "image-puller-cluster-role", defaultOptions.imagePullerClusterRole, "ClusterRole bound to the pipeline service account in the release namespace to pull images (empty disables the binding)")
+	fs.StringVar(&opts.pipelineServiceAccount, "pipeline-service-account", defaultOptions.pipelineServiceAccount, "Name of the service account the pipeline runs as")
+}
+
+// registerPreviewFlags registers the flags of preview environments.
+func registerPreviewFlags(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.preview, "preview", defaultOptions.preview, "Whether to deploy into a preview environment, with namespace and release name computed from templates")
+	fs.StringVar(&opts.previewNamespaceTemplate, "preview-namespace-template", defaultOptions.previewNamespaceTemplate, "Template of the preview namespace, rendered with the ODS context and .Key (pull request key or Git ref)")
+	fs.StringVar(&opts.previewReleaseTemplate, "preview-release-template", defaultOptions.previewReleaseTemplate, "Template of the preview release name, rendered with the ODS context and .Key (pull request key or Git ref)")
+	fs.DurationVar(&opts.previewTTL, "preview-ttl", defaultOptions.previewTTL, "How long a preview environment is kept after its last deployment")
+	fs.BoolVar(&opts.previewGC, "preview-gc", defaultOptions.previewGC, "Whether to delete expired preview environments of the project instead of deploying (see -dry-run)")
+}
+
+// registerDeployFlags registers the flags of the deploy subcommand.
+func registerDeployFlags(fs *flag.FlagSet, opts *options) {
+	registerDiffFlags(fs, opts)
+	registerPromoteFlags(fs, opts)
+	registerRevisionResultFlags(fs, opts)
+	fs.BoolVar(&opts.diffOnly, "diff-only", defaultOptions.diffOnly, "Whether to perform only a diff")
+	fs.BoolVar(&opts.gatherStatus, "gather-status", defaultOptions.gatherStatus, "Whether to gather the Helm release status")
+	fs.BoolVar(&opts.requireApproval, "require-approval", defaultOptions.requireApproval, "Whether detected drift needs to be approved before upgrading")
+	fs.DurationVar(&opts.approvalTimeout, "approval-timeout", defaultOptions.approvalTimeout, "How long to wait for the approval of detected drift")
+	fs.StringVar(&opts.approvalThreshold, "approval-threshold", defaultOptions.approvalThreshold, "Lowest change class requiring approval (image-only, scaling, config, crd-change or destructive)")
+	fs.StringVar(&opts.onDestructiveChange, "on-destructive-change", defaultOptions.onDestructiveChange, "Action to take when destructive changes are detected (allow, stop or fail)")
+	fs.StringVar(&opts.readinessChecksFile, "readiness-checks-file", defaultOptions.readinessChecksFile, "Location of the readiness checks file (defaults to readiness-checks.yaml in the chart dir)")
+	fs.DurationVar(&opts.progressInterval, "progress-interval", defaultOptions.progressInterval, "Interval in which to report the rollout progress during the upgrade (0 disables it)")
+	fs.StringVar(&opts.upgradedResultPath, "upgraded-result-path", defaultOptions.upgradedResultPath, "Path of the Tekton result file to write whether an upgrade happened to")
+	fs.StringVar(&opts.pendingReleasePolicy, "pending-release-policy", defaultOptions.pendingReleasePolicy, "How to recover a release stuck in a pending state (none, rollback or mark-failed)")
+	fs.DurationVar(&opts.pendingReleaseThreshold, "pending-release-threshold", defaultOptions.pendingReleaseThreshold, "How long a release must be pending before it is recovered")
+	fs.BoolVar(&opts.preflight, "preflight", defaultOptions.preflight, "Whether to check connectivity and permissions in the target namespace before doing any work")
+	fs.BoolVar(&opts.teardown, "teardown", defaultOptions.teardown, "Whether to tear down the release instead of deploying it (see -delete-images, -delete-namespace and -dry-run)")
+	fs.BoolVar(&opts.driftCheck, "drift-check", defaultOptions.driftCheck, "Whether to only check the deployed release for drift (against the live cluster state and the chart)")
+	fs.StringVar(&opts.driftDetectedResultPath, "drift-detected-result-path", defaultOptions.driftDetectedResultPath, "Path of the Tekton result file to write whether drift was detected to")
+}
+
+// deploySteps returns the steps of the deploy and diff subcommands.
+func deploySteps(opts options) []DeployStep {
+	if opts.previewGC {
+		return []DeployStep{
+			setupContext(),
+			collectExpiredPreviews(),
+		}
+	}
+	if opts.teardown {
+		return teardownSteps(opts)
+	}
+	if opts.driftCheck {
+		return []DeployStep{
+			setupContext(),
+			initResults(),
+			skipOnEmptyNamespace(),
+			setReleaseTarget(),
+			detectSubrepos(),
+			collectValuesFiles(),
+			importKeys(),
+			checkSecretsDecryptable(),
+			redactSecretValues(),
+			detectDrift(),
+		}
+	}
+	return []DeployStep{
+		setupContext(),
+		setPreviewTarget(),
+		initResults(),
+		skipOnEmptyNamespace(),
+		setReleaseTarget(),
+		runPreflight(),
+		ensureNamespace(),
+		detectSubrepos(),
+		listHelmPlugins(),
+		packageHelmChartWithSubcharts(),
+		collectValuesFiles(),
+		importKeys(),
+		checkSecretsDecryptable(),
+		redactSecretValues(),
+		lockRelease(),
+		recoverPendingRelease(),
+		diffHelmRelease(),
+		checkDestructiveChanges(),
+		awaitApproval(),
+		detectImageDigests(),
+		copyImagesIntoReleaseNamespace(),
+		onFailure(gatherFailureDiagnostics()),
+		upgradeHelmRelease(),
+		runReadinessChecks(),
+		gatherHelmStatus(),
+	}
+}
+
+// promoteSteps returns the steps of the promote subcommand.
+func promoteSteps(opts options) []DeployStep {
+	return []DeployStep{
+		setupContext(),
+		initResults(),
+		skipOnEmptyNamespace(),
+		setReleaseTarget(),
+		detectSubrepos(),
+		detectImageDigests(),
+		copyImagesIntoReleaseNamespace(),
+	}
+}
+
+// statusSteps returns the steps of the status subcommand.
+func statusSteps(opts options) []DeployStep {
+	return []DeployStep{
+		setupContext(),
+		initResults(),
+		skipOnEmptyNamespace(),
+		setReleaseTarget(),
+		writeReleaseRevision(),
+		gatherHelmStatus(),
+	}
+}
+
+// rollbackSteps returns the steps of the rollback subcommand.
+func rollbackSteps(opts options) []DeployStep {
+	return []DeployStep{
+		setupContext(),
+		initResults(),
+		skipOnEmptyNamespace(),
+		setReleaseTarget(),
+		lockRelease(),
+		onFailure(gatherFailureDiagnostics()),
+		rollbackHelmRelease(),
+		writeReleaseRevision(),
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := map[string]struct {
+		args        []string
+		wantCommand string
+		wantOpts    func(opts *options)
+		wantErr     bool
+	}{
+		"no subcommand runs deploy with all flags": {
+			args:        []string{"-namespace=foo-dev", "-diff-only", "-upgrade-flags=--install", "-age-key-secret=keys"},
+			wantCommand: "deploy",
+			wantOpts: func(opts *options) {
+				opts.namespace = "foo-dev"
+				opts.diffOnly = true
+				opts.upgradeFlags = "--install"
+				opts.ageKeySecret = "keys"
+			},
+		},
+		"no arguments": {
+			args:        []string{},
+			wantCommand: "deploy",
+			wantOpts:    func(opts *options) {},
+		},
+		"deploy subcommand": {
+			args:        []string{"deploy", "-approval-timeout=1m"},
+			wantCommand: "deploy",
+			wantOpts:    func(opts *options) { opts.approvalTimeout = time.Minute },
+		},
+		"diff subcommand implies diff only": {
+			args:        []string{"diff", "-namespace=foo-dev"},
+			wantCommand: "diff",
+			wantOpts: func(opts *options) {
+				opts.namespace = "foo-dev"
+				opts.diffOnly = true
+			},
+		},
+		"status subcommand implies gathering status": {
+			args:        []string{"status", "-namespace=foo-dev"},
+			wantCommand: "status",
+			wantOpts: func(opts *options) {
+				opts.namespace = "foo-dev"
+				opts.gatherStatus = true
+			},
+		},
+		"rollback subcommand": {
+			args:        []string{"rollback", "-namespace=foo-dev", "-revision=3"},
+			wantCommand: "rollback",
+			wantOpts: func(opts *options) {
+				opts.namespace = "foo-dev"
+				opts.rollbackRevision = 3
+			},
+		},
+		"flag of other subcommand": {
+			args:    []string{"status", "-upgrade-flags=--install"},
+			wantErr: true,
+		},
+		"unknown subcommand": {
+			args:    []string{"upgrade"},
+			wantErr: true,
+		},
+		"unexpected arguments": {
+			args:    []string{"uninstall", "foo"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cmd, opts, err := parseArgs(tc.args, io.Discard)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.name != tc.wantCommand {
+				t.Fatalf("want subcommand %s, got %s", tc.wantCommand, cmd.name)
+			}
+			want := subcommandDefaults(t, cmd)
+			tc.wantOpts(&want)
+			if diff := cmp.Diff(want, opts, cmp.AllowUnexported(options{})); diff != "" {
+				t.Fatalf("options mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseArgsKeepsDefaultsOfUnregisteredFlags(t *testing.T) {
+	tests := map[string]struct {
+		args []string
+		get  func(opts options) interface{}
+	}{
+		"preflight of diff": {
+			args: []string{"diff"},
+			get:  func(opts options) interface{} { return opts.preflight },
+		},
+		"release lock of diff": {
+			args: []string{"diff"},
+			get:  func(opts options) interface{} { return opts.releaseLock },
+		},
+		"destructive change policy of diff": {
+			args: []string{"diff"},
+			get:  func(opts options) interface{} { return opts.onDestructiveChange },
+		},
+		"pending release policy of diff": {
+			args: []string{"diff"},
+			get:  func(opts options) interface{} { return opts.pendingReleasePolicy },
+		},
+		"release lock timeout of rollback": {
+			args: []string{"rollback"},
+			get:  func(opts options) interface{} { return opts.releaseLockTimeout },
+		},
+		"age key secret field of status": {
+			args: []string{"status"},
+			get:  func(opts options) interface{} { return opts.ageKeySecretField },
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, opts, err := parseArgs(tc.args, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.get(defaultOptions), tc.get(opts)); diff != "" {
+				t.Fatalf("option mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// subcommandDefaults returns the defaults of the flags of cmd.
+func subcommandDefaults(t *testing.T, cmd *subcommand) options {
+	opts := defaultOptions
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	for _, register := range cmd.flags {
+		register(fs, &opts)
+	}
+	if err := fs.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Fields of the secret holding the credentials of an external cluster.
+const (
+	credentialsTokenField      = "token"
+	credentialsCAField         = "ca.crt"
+	credentialsCertField       = "tls.crt"
+	credentialsKeyField        = "tls.key"
+	credentialsKubeconfigField = "kubeconfig"
+)
+
+// readTargetCredentials reads the credentials of the external cluster from
+// the secret into targetConfig. The secret holds a token or a client
+// certificate and key, optionally with the CA certificate of the API server,
+// or a kubeconfig. Fields given next to a kubeconfig take precedence. The
+// server of a kubeconfig must be the API server of targetConfig.
+func readTargetCredentials(clientset kubernetes.Interface, namespace, name string, targetConfig *targetEnvironment) error {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if kubeconfig, ok := secret.Data[credentialsKubeconfigField]; ok {
+		err := credentialsFromKubeconfig(kubeconfig, targetConfig)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", credentialsKubeconfigField, err)
+		}
+	}
+	if v, ok := secret.Data[credentialsTokenField]; ok {
+		targetConfig.APIToken = string(v)
+	}
+	if v, ok := secret.Data[credentialsCAField]; ok {
+		targetConfig.CAData = v
+	}
+	if v, ok := secret.Data[credentialsCertField]; ok {
+		targetConfig.CertData = v
+	}
+	if v, ok := secret.Data[credentialsKeyField]; ok {
+		targetConfig.KeyData = v
+	}
+	if (len(targetConfig.CertData) > 0) != (len(targetConfig.KeyData) > 0) {
+		return fmt.Errorf("client certificate (%s) and key (%s) must be given together", credentialsCertField, credentialsKeyField)
+	}
+	if targetConfig.APIToken == "" && len(targetConfig.CertData) == 0 {
+		return fmt.Errorf(
+			"no credentials found, expected field %s, fields %s and %s, or field %s",
+			credentialsTokenField, credentialsCertField, credentialsKeyField, credentialsKubeconfigField,
+		)
+	}
+	return nil
+}
+
+// credentialsFromKubeconfig reads the credentials of the current context of
+// the kubeconfig into targetConfig. Credentials referring to files are not
+// supported as the files are not available in the task.
+func credentialsFromKubeconfig(kubeconfig []byte, targetConfig *targetEnvironment) error {
+	clientConfig, err := clientcmd.NewClientConfigFromBytes(kubeconfig)
+	if err != nil {
+		return err
+	}
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	if config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" || config.BearerTokenFile != "" {
+		return errors.New("credentials must be embedded in the kubeconfig instead of referring to files")
+	}
+	if config.Host != "" && strings.TrimSuffix(config.Host, "/") != strings.TrimSuffix(targetConfig.APIServer, "/") {
+		return fmt.Errorf("kubeconfig is for server %s, but the API server is %s", config.Host, targetConfig.APIServer)
+	}
+	if config.Insecure && !targetConfig.Insecure {
+		return errors.New("kubeconfig disables TLS verification, which must be enabled explicitly with -api-insecure-skip-tls-verify")
+	}
+	targetConfig.APIToken = config.BearerToken
+	targetConfig.CAData = config.CAData
+	targetConfig.CertData = config.CertData
+	targetConfig.KeyData = config.KeyData
+	return nil
+}
+
+// needsKubeconfig returns whether the credentials of the external cluster
+// can only be passed to Helm in a kubeconfig file, as Helm has no flags for
+// CA and client certificate data, and the Helm version of the task no flag
+// to skip TLS verification.
+func (t *targetEnvironment) needsKubeconfig() bool {
+	return t.APIServer != "" && (len(t.CAData) > 0 || len(t.CertData) > 0 || t.Insecure)
+}
+
+// restConfig returns the config to access the external cluster.
+func (t *targetEnvironment) restConfig() *rest.Config {
+	config := &rest.Config{
+		Host:        t.APIServer,
+		BearerToken: t.APIToken,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: t.Insecure,
+			CertData: t.CertData,
+			KeyData:  t.KeyData,
+		},
+	}
+	// A CA cannot be combined with skipping TLS verification.
+	if !t.Insecure {
+		config.CAData = t.CAData
+	}
+	return config
+}
+
+// writeKubeconfig writes the credentials of the external cluster as
+// kubeconfig into dir and returns the path of the file.
+func (t *targetEnvironment) writeKubeconfig(dir string) (string, error) {
+	config := t.restConfig()
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["target"] = &clientcmdapi.Cluster{
+		Server:                   config.Host,
+		CertificateAuthorityData: config.CAData,
+		InsecureSkipTLSVerify:    config.Insecure,
+	}
+	kubeconfig.AuthInfos["target"] = &clientcmdapi.AuthInfo{
+		Token:                 config.BearerToken,
+		ClientCertificateData: config.CertData,
+		ClientKeyData:         config.KeyData,
+	}
+	kubeconfig.Contexts["target"] = &clientcmdapi.Context{
+		Cluster:   "target",
+		AuthInfo:  "target",
+		Namespace: t.Namespace,
+	}
+	kubeconfig.CurrentContext = "target"
+	filename := filepath.Join(dir, "kubeconfig")
+	err := clientcmd.WriteToFile(*kubeconfig, filename)
+	if err != nil {
+		return "", fmt.Errorf("write kubeconfig: %w", err)
+	}
+	return filename, nil
+}
+
+// targetHelmArgs returns the arguments selecting the external cluster for
+// Helm, if one is configured.
+func (d *deployHelm) targetHelmArgs() []string {
+	if d.targetConfig.APIServer == "" {
+		return nil
+	}
+	if d.targetConfig.KubeconfigFile != "" {
+		return []string{fmt.Sprintf("--kubeconfig=%s", d.targetConfig.KubeconfigFile)}
+	}
+	return []string{
+		fmt.Sprintf("--kube-apiserver=%s", d.targetConfig.APIServer),
+		fmt.Sprintf("--kube-token=%s", d.targetConfig.APIToken),
+	}
+}
+
+// writeTargetKubeconfig writes the kubeconfig passed to Helm if the
+// credentials of the external cluster require it. The file is removed once
+// all steps are done.
+func (d *deployHelm) writeTargetKubeconfig(targetConfig *targetEnvironment) error {
+	if !targetConfig.needsKubeconfig() {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "deploy-helm-kubeconfig-")
+	if err != nil {
+		return fmt.Errorf("create kubeconfig dir: %w", err)
+	}
+	d.addCleanup(func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			d.logger.Warnf("Could not remove kubeconfig dir %s: %s", dir, err)
+		}
+	})
+	filename, err := targetConfig.writeKubeconfig(dir)
+	if err != nil {
+		return err
+	}
+	targetConfig.KubeconfigFile = filename
+	return nil
+}
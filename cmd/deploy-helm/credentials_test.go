@@ -0,0 +1,272 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestReadTargetCredentials(t *testing.T) {
+	kubeconfig := func(cluster *clientcmdapi.Cluster, authInfo *clientcmdapi.AuthInfo) []byte {
+		config := clientcmdapi.NewConfig()
+		config.Clusters["c"] = cluster
+		config.AuthInfos["u"] = authInfo
+		config.Contexts["ctx"] = &clientcmdapi.Context{Cluster: "c", AuthInfo: "u"}
+		config.CurrentContext = "ctx"
+		b, err := clientcmd.Write(*config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := map[string]struct {
+		data     map[string][]byte
+		insecure bool
+		want     *targetEnvironment
+		wantErr  bool
+	}{
+		"token": {
+			data: map[string][]byte{"token": []byte("s3cr3t")},
+			want: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t"},
+		},
+		"token and CA": {
+			data: map[string][]byte{"token": []byte("s3cr3t"), "ca.crt": []byte("ca")},
+			want: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", CAData: []byte("ca")},
+		},
+		"client certificate": {
+			data: map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key"), "ca.crt": []byte("ca")},
+			want: &targetEnvironment{APIServer: "https://api.example.com", CAData: []byte("ca"), CertData: []byte("cert"), KeyData: []byte("key")},
+		},
+		"client certificate without key": {
+			data:    map[string][]byte{"tls.crt": []byte("cert")},
+			wantErr: true,
+		},
+		"kubeconfig": {
+			data: map[string][]byte{"kubeconfig": kubeconfig(
+				&clientcmdapi.Cluster{Server: "https://api.example.com", CertificateAuthorityData: []byte("ca")},
+				&clientcmdapi.AuthInfo{Token: "s3cr3t"},
+			)},
+			want: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", CAData: []byte("ca")},
+		},
+		"kubeconfig with CA from secret field": {
+			data: map[string][]byte{
+				"kubeconfig": kubeconfig(
+					&clientcmdapi.Cluster{Server: "https://api.example.com", CertificateAuthorityData: []byte("ca")},
+					&clientcmdapi.AuthInfo{ClientCertificateData: []byte("cert"), ClientKeyData: []byte("key")},
+				),
+				"ca.crt": []byte("other-ca"),
+			},
+			want: &targetEnvironment{APIServer: "https://api.example.com", CAData: []byte("other-ca"), CertData: []byte("cert"), KeyData: []byte("key")},
+		},
+		"kubeconfig for other server": {
+			data: map[string][]byte{"kubeconfig": kubeconfig(
+				&clientcmdapi.Cluster{Server: "https://other.example.com"},
+				&clientcmdapi.AuthInfo{Token: "s3cr3t"},
+			)},
+			wantErr: true,
+		},
+		"kubeconfig referring to files": {
+			data: map[string][]byte{"kubeconfig": kubeconfig(
+				&clientcmdapi.Cluster{Server: "https://api.example.com", CertificateAuthority: "/etc/ca.crt"},
+				&clientcmdapi.AuthInfo{Token: "s3cr3t"},
+			)},
+			wantErr: true,
+		},
+		"insecure kubeconfig without opt-in": {
+			data: map[string][]byte{"kubeconfig": kubeconfig(
+				&clientcmdapi.Cluster{Server: "https://api.example.com", InsecureSkipTLSVerify: true},
+				&clientcmdapi.AuthInfo{Token: "s3cr3t"},
+			)},
+			wantErr: true,
+		},
+		"insecure kubeconfig with opt-in": {
+			data: map[string][]byte{"kubeconfig": kubeconfig(
+				&clientcmdapi.Cluster{Server: "https://api.example.com", InsecureSkipTLSVerify: true},
+				&clientcmdapi.AuthInfo{Token: "s3cr3t"},
+			)},
+			insecure: true,
+			want:     &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", Insecure: true},
+		},
+		"no credentials": {
+			data:    map[string][]byte{"ca.crt": []byte("ca")},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "api-credentials", Namespace: "foo-cd"},
+				Data:       tc.data,
+			})
+			got := &targetEnvironment{APIServer: "https://api.example.com", Insecure: tc.insecure}
+			err := readTargetCredentials(clientset, "foo-cd", "api-credentials", got)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("credentials mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTargetHelmArgs(t *testing.T) {
+	tests := map[string]struct {
+		targetConfig *targetEnvironment
+		want         []string
+	}{
+		"in-cluster": {
+			targetConfig: &targetEnvironment{},
+			want:         nil,
+		},
+		"token": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t"},
+			want:         []string{"--kube-apiserver=https://api.example.com", "--kube-token=s3cr3t"},
+		},
+		"kubeconfig": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", KubeconfigFile: "/tmp/kubeconfig"},
+			want:         []string{"--kubeconfig=/tmp/kubeconfig"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := &deployHelm{targetConfig: tc.targetConfig}
+			if diff := cmp.Diff(tc.want, d.targetHelmArgs()); diff != "" {
+				t.Fatalf("args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNeedsKubeconfig(t *testing.T) {
+	tests := map[string]struct {
+		targetConfig *targetEnvironment
+		want         bool
+	}{
+		"in-cluster": {
+			targetConfig: &targetEnvironment{Insecure: true},
+			want:         false,
+		},
+		"token": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t"},
+			want:         false,
+		},
+		"token and CA": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", CAData: []byte("ca")},
+			want:         true,
+		},
+		"client certificate": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", CertData: []byte("cert"), KeyData: []byte("key")},
+			want:         true,
+		},
+		"insecure": {
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", Insecure: true},
+			want:         true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.targetConfig.needsKubeconfig(); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWriteKubeconfig(t *testing.T) {
+	targetConfig := &targetEnvironment{
+		APIServer: "https://api.example.com",
+		CAData:    []byte("ca"),
+		CertData:  []byte("cert"),
+		KeyData:   []byte("key"),
+		Namespace: "foo-dev",
+	}
+	if !targetConfig.needsKubeconfig() {
+		t.Fatal("want kubeconfig to be needed for client certificates")
+	}
+	filename, err := targetConfig.writeKubeconfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(targetConfig.restConfig().TLSClientConfig, config.TLSClientConfig); diff != "" {
+		t.Fatalf("TLS config mismatch (-want +got):\n%s", diff)
+	}
+	if config.Host != targetConfig.APIServer {
+		t.Fatalf("want host %s, got %s", targetConfig.APIServer, config.Host)
+	}
+
+	insecureConfig := &targetEnvironment{APIServer: "https://api.example.com", APIToken: "s3cr3t", Insecure: true}
+	filename, err = insecureConfig.writeKubeconfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = clientcmd.BuildConfigFromFlags("", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Insecure || config.BearerToken != "s3cr3t" {
+		t.Fatalf("want insecure config with token, got insecure=%v", config.Insecure)
+	}
+}
+
+func TestSetTargetEnvironment(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-credentials", Namespace: "foo-cd"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	})
+	newDeployHelm := func(opts options) *deployHelm {
+		return &deployHelm{
+			logger:     testLogger(),
+			opts:       opts,
+			clientset:  clientset,
+			restConfig: &rest.Config{Host: "https://pipeline.example.com"},
+			ctxt:       &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+			redactor:   redact.New(),
+		}
+	}
+
+	t.Run("same cluster", func(t *testing.T) {
+		d := newDeployHelm(options{namespace: "foo-dev"})
+		err := d.setTargetEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.targetClientset != d.clientset {
+			t.Fatal("want pipeline clientset to be used for the target")
+		}
+	})
+
+	t.Run("external cluster", func(t *testing.T) {
+		d := newDeployHelm(options{namespace: "foo-dev", apiServer: "https://api.example.com", apiCredentialsSecret: "api-credentials"})
+		err := d.setTargetEnvironment()
+		defer d.cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := d.targetClientset.(*kubernetes.Clientset); !ok {
+			t.Fatalf("want clientset of external cluster, got %T", d.targetClientset)
+		}
+		if got := d.redactor.String("token s3cr3t"); got != "token ***" {
+			t.Fatalf("want token to be redacted, got %q", got)
+		}
+	})
+}
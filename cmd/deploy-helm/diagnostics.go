@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// podLogTailLines is the number of log lines gathered per crashing container.
+	podLogTailLines = 50
+	// failedRevisionsToSearch is the number of revisions searched for the last failed one.
+	failedRevisionsToSearch = 10
+)
+
+// crashingContainer identifies a container which crashed.
+type crashingContainer struct {
+	pod       string
+	container string
+	reason    string
+	// Whether the container restarted, in which case the logs of the
+	// previous instance are of interest.
+	restarted bool
+}
+
+// gatherFailureDiagnostics gathers the release status, the notes of the last
+// failed revision and the logs of crashing pods of the release. The
+// diagnostics are printed and written as an artifact.
+func gatherFailureDiagnostics() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		d.logger.Infof("Gathering diagnostics of release %s after failure ...", d.releaseName)
+		var report strings.Builder
+
+		err := d.writeStatusArtifact()
+		if err != nil {
+			d.logger.Warnf("Could not gather release status: %s", err)
+		}
+
+		history, err := d.releaseHistory(failedRevisionsToSearch)
+		if err != nil {
+			d.logger.Warnf("Could not get release history: %s", err)
+		} else if failed := lastFailedRevision(history); failed != nil {
+			fmt.Fprintf(&report, "Last failed revision: %d (%s)\n", failed.Revision, failed.Description)
+			notes, err := d.releaseNotes(failed.Revision)
+			if err != nil {
+				d.logger.Warnf("Could not get notes of revision %d: %s", failed.Revision, err)
+			} else {
+				fmt.Fprintf(&report, "Notes:\n%s\n", notes)
+			}
+		}
+
+		workloads, err := d.releaseWorkloads()
+		if err != nil {
+			d.logger.Warnf("Could not gather workloads: %s", err)
+		}
+		for _, w := range workloads {
+			for _, c := range crashingContainers(w.pods) {
+				fmt.Fprintf(&report, "Logs of container %s in pod %s (%s):\n", c.container, c.pod, c.reason)
+				logs, err := containerLogs(d.targetClientset, w.Namespace, c)
+				if err != nil {
+					fmt.Fprintf(&report, "Could not get logs: %s\n\n", err)
+					continue
+				}
+				fmt.Fprintf(&report, "%s\n\n", strings.TrimRight(logs, "\n"))
+			}
+		}
+
+		if report.Len() == 0 {
+			return d, nil
+		}
+		content := d.redactor.String(report.String())
+		fmt.Print(content)
+		err = writeDeploymentArtifact([]byte(content), "failure-"+d.releaseName, d.opts.chartDir, d.releaseNamespace)
+		if err != nil {
+			return d, fmt.Errorf("write failure diagnostics artifact: %w", err)
+		}
+		return d, nil
+	}
+}
+
+// lastFailedRevision returns the most recent failed revision in history
+// (ordered oldest first), or nil if there is none.
+func lastFailedRevision(history []helmRevision) *helmRevision {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Status == "failed" {
+			return &history[i]
+		}
+	}
+	return nil
+}
+
+// crashingContainers returns the containers of pods which are waiting to
+// restart after a crash, or which terminated with an error.
+func crashingContainers(pods []corev1.Pod) []crashingContainer {
+	crashing := []crashingContainer{}
+	for _, p := range pods {
+		statuses := append(append([]corev1.ContainerStatus{}, p.Status.InitContainerStatuses...), p.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			reason := ""
+			switch {
+			case cs.State.Waiting != nil && cs.RestartCount > 0:
+				reason = cs.State.Waiting.Reason
+			case cs.State.Terminated != nil && cs.State.Terminated.ExitCode != 0:
+				reason = fmt.Sprintf("%s, exit code %d", cs.State.Terminated.Reason, cs.State.Terminated.ExitCode)
+			default:
+				continue
+			}
+			crashing = append(crashing, crashingContainer{
+				pod:       p.Name,
+				container: cs.Name,
+				reason:    reason,
+				restarted: cs.State.Waiting != nil && cs.RestartCount > 0,
+			})
+		}
+	}
+	return crashing
+}
+
+// containerLogs returns the last lines of the logs of the crashing container.
+func containerLogs(clientset kubernetes.Interface, namespace string, c crashingContainer) (string, error) {
+	tailLines := int64(podLogTailLines)
+	req := clientset.CoreV1().Pods(namespace).GetLogs(c.pod, &corev1.PodLogOptions{
+		Container: c.container,
+		TailLines: &tailLines,
+		Previous:  c.restarted,
+	})
+	stream, err := req.Stream(context.TODO())
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	logs, err := io.ReadAll(stream)
+	if err != nil {
+		return "", err
+	}
+	return string(logs), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRunStepsRunsFailureSteps(t *testing.T) {
+	tests := map[string]struct {
+		failingStep DeployStep
+		wantErr     string
+		wantRun     bool
+	}{
+		"failure": {
+			failingStep: func(d *deployHelm) (*deployHelm, error) {
+				return d, errors.New("upgrade failed")
+			},
+			wantErr: "upgrade failed",
+			wantRun: true,
+		},
+		"skip": {
+			failingStep: func(d *deployHelm) (*deployHelm, error) {
+				return d, &skipRemainingSteps{"skipping"}
+			},
+			wantRun: false,
+		},
+		"success": {
+			failingStep: func(d *deployHelm) (*deployHelm, error) {
+				return d, nil
+			},
+			wantRun: false,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ran := false
+			diagnostics := func(d *deployHelm) (*deployHelm, error) {
+				ran = true
+				return d, errors.New("diagnostics failed")
+			}
+			d := &deployHelm{logger: testLogger()}
+			err := d.runSteps(onFailure(diagnostics), tc.failingStep)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+				t.Fatalf("want error %q, got: %v", tc.wantErr, err)
+			}
+			if ran != tc.wantRun {
+				t.Fatalf("want failure steps run: %v, got: %v", tc.wantRun, ran)
+			}
+		})
+	}
+}
+
+func TestCrashingContainers(t *testing.T) {
+	pods := []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-1"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:         "app",
+					RestartCount: 3,
+					State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				},
+				{
+					Name:  "sidecar",
+					State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+				},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-2"},
+			Status: corev1.PodStatus{
+				InitContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name:  "migrate",
+						State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+					},
+				},
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name:  "app",
+						State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}},
+					},
+				},
+			},
+		},
+	}
+	got := crashingContainers(pods)
+	want := []crashingContainer{
+		{pod: "foo-1", container: "app", reason: "CrashLoopBackOff", restarted: true},
+		{pod: "foo-2", container: "migrate", reason: "Error, exit code 1"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(crashingContainer{})); diff != "" {
+		t.Fatalf("crashing containers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLastFailedRevision(t *testing.T) {
+	history := []helmRevision{
+		{Revision: 1, Status: "superseded"},
+		{Revision: 2, Status: "failed"},
+		{Revision: 3, Status: "deployed"},
+		{Revision: 4, Status: "failed"},
+	}
+	got := lastFailedRevision(history)
+	if got == nil || got.Revision != 4 {
+		t.Fatalf("want revision 4, got: %v", got)
+	}
+	if got := lastFailedRevision(history[:1]); got != nil {
+		t.Fatalf("want no failed revision, got: %v", got)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/shlex"
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// gitBin is the name of the git binary, used to check out the commit from
+// which a release has been deployed.
+const gitBin = "git"
+
+// manifestObject is a K8s resource as found in a Helm manifest.
+type manifestObject struct {
+	unstructured.Unstructured
+}
+
+// key identifies the object within a manifest.
+func (o manifestObject) key() string {
+	if o.GetNamespace() != "" {
+		return fmt.Sprintf("%s/%s (%s)", o.GetKind(), o.GetName(), o.GetNamespace())
+	}
+	return fmt.Sprintf("%s/%s", o.GetKind(), o.GetName())
+}
+
+// isSecret returns whether the object is a K8s Secret.
+func (o manifestObject) isSecret() bool {
+	return o.GetAPIVersion() == "v1" && o.GetKind() == "Secret"
+}
+
+// driftReport collects the differences found by a drift check.
+type driftReport struct {
+	// Differences between the live objects and the release manifest, per object.
+	live map[string][]string
+	// Differences between the release manifest and the rendered chart, per object.
+	chart map[string][]string
+	// Reason why the release manifest has not been compared to the chart.
+	chartSkipped string
+}
+
+func newDriftReport() *driftReport {
+	return &driftReport{live: map[string][]string{}, chart: map[string][]string{}}
+}
+
+// detected returns whether any drift has been found.
+func (r *driftReport) detected() bool {
+	return len(r.live) > 0 || len(r.chart) > 0
+}
+
+// String renders the report as plain text suitable for the drift artifact.
+func (r *driftReport) String() string {
+	var b strings.Builder
+	writeSection := func(title string, differences map[string][]string, skipped string) {
+		fmt.Fprintf(&b, "%s:\n", title)
+		if skipped != "" {
+			fmt.Fprintf(&b, "  Not compared: %s\n\n", skipped)
+			return
+		}
+		if len(differences) == 0 {
+			fmt.Fprintln(&b, "  No drift detected.")
+		}
+		keys := make([]string, 0, len(differences))
+		for k := range differences {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "  %s:\n", k)
+			for _, d := range differences[k] {
+				fmt.Fprintf(&b, "    %s\n", d)
+			}
+		}
+		fmt.Fprintln(&b)
+	}
+	writeSection("Live cluster state compared to release manifest", r.live, "")
+	writeSection("Release manifest compared to chart", r.chart, r.chartSkipped)
+	return b.String()
+}
+
+// parseManifest splits a multi-document YAML manifest into objects.
+// Empty documents are skipped.
+func parseManifest(manifest string) ([]manifestObject, error) {
+	objects := []manifestObject{}
+	for _, doc := range strings.Split("\n"+manifest, "\n---") {
+		var content map[string]interface{}
+		err := yaml.Unmarshal([]byte(doc), &content)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal manifest: %w", err)
+		}
+		if len(content) == 0 {
+			continue
+		}
+		objects = append(objects, manifestObject{unstructured.Unstructured{Object: content}})
+	}
+	return objects, nil
+}
+
+// compareFields compares all fields set in want with the respective fields
+// in got. Fields only present in got (such as defaults or status set by the
+// cluster) are ignored. Each difference is returned as a line of the form
+// "<path>: <what> <want>, <than> <got>".
+func compareFields(path string, want, got interface{}, what, than string) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %s %s, %s %s", path, what, formatValue(want), than, formatValue(got))}
+		}
+		differences := []string{}
+		for _, k := range sortedFieldNames(w) {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if _, ok := g[k]; !ok {
+				differences = append(differences, fmt.Sprintf("%s: %s %s, %s <none>", p, what, formatValue(w[k]), than))
+				continue
+			}
+			differences = append(differences, compareFields(p, w[k], g[k], what, than)...)
+		}
+		return differences
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(w) != len(g) {
+			return []string{fmt.Sprintf("%s: %s %s, %s %s", path, what, formatValue(want), than, formatValue(got))}
+		}
+		differences := []string{}
+		for i := range w {
+			differences = append(differences, compareFields(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], what, than)...)
+		}
+		return differences
+	}
+	if equalScalars(want, got) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s %s, %s %s", path, what, formatValue(want), than, formatValue(got))}
+}
+
+// equalScalars compares two scalar values. Resource quantities which are
+// equal but formatted differently (e.g. "1Gi" and "1024Mi") are considered
+// equal, as the cluster may normalize them.
+func equalScalars(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if !aok || !bok {
+		return false
+	}
+	aq, err := resource.ParseQuantity(as)
+	if err != nil {
+		return false
+	}
+	bq, err := resource.ParseQuantity(bs)
+	if err != nil {
+		return false
+	}
+	return aq.Cmp(bq) == 0
+}
+
+func sortedFieldNames(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// normalize converts v into its generic JSON representation so that
+// values parsed from YAML and values returned by the API server can be
+// compared (e.g. numbers are float64 in both cases).
+func normalize(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(b, &n)
+	return n, err
+}
+
+// splitSecretData removes data and stringData from the normalized Secret
+// object obj and returns its data as stored by the API server, i.e. with the
+// values of stringData base64 encoded and merged into data.
+func splitSecretData(obj interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	o, ok := obj.(map[string]interface{})
+	if !ok {
+		return data
+	}
+	if d, ok := o["data"].(map[string]interface{}); ok {
+		for k, v := range d {
+			data[k] = v
+		}
+	}
+	if sd, ok := o["stringData"].(map[string]interface{}); ok {
+		for k, v := range sd {
+			data[k] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v)))
+		}
+	}
+	delete(o, "data")
+	delete(o, "stringData")
+	return data
+}
+
+// compareSecretData compares the data of two Secrets like compareFields,
+// without revealing any values.
+func compareSecretData(want, got map[string]interface{}, what, than string) []string {
+	differences := []string{}
+	for _, k := range sortedFieldNames(want) {
+		g, ok := got[k]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("data.%s: %s <set>, %s <none>", k, what, than))
+		} else if !reflect.DeepEqual(want[k], g) {
+			differences = append(differences, fmt.Sprintf("data.%s: %s and %s values differ", k, what, than))
+		}
+	}
+	return differences
+}
+
+// compareLive compares each object of the release manifest with the live
+// object in the cluster, reporting missing objects and modified fields.
+func compareLive(client dynamic.Interface, mapper meta.RESTMapper, namespace string, objects []manifestObject) (map[string][]string, error) {
+	drift := map[string][]string{}
+	for _, o := range objects {
+		gvk := o.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", o.key(), err)
+		}
+		var resourceClient dynamic.ResourceInterface = client.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			ns := o.GetNamespace()
+			if ns == "" {
+				ns = namespace
+			}
+			resourceClient = client.Resource(mapping.Resource).Namespace(ns)
+		}
+		live, err := resourceClient.Get(context.TODO(), o.GetName(), metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				drift[o.key()] = []string{"object has been deleted from the cluster"}
+				continue
+			}
+			return nil, fmt.Errorf("get %s: %w", o.key(), err)
+		}
+		want, err := normalize(o.Object)
+		if err != nil {
+			return nil, fmt.Errorf("normalize %s: %w", o.key(), err)
+		}
+		got, err := normalize(live.Object)
+		if err != nil {
+			return nil, fmt.Errorf("normalize live %s: %w", o.key(), err)
+		}
+		var wantData, gotData map[string]interface{}
+		if o.isSecret() {
+			wantData, gotData = splitSecretData(want), splitSecretData(got)
+		}
+		differences := compareFields("", want, got, "release", "live")
+		differences = append(differences, compareSecretData(wantData, gotData, "release", "live")...)
+		if len(differences) > 0 {
+			drift[o.key()] = differences
+		}
+	}
+	return drift, nil
+}
+
+// compareChart compares the objects of the release manifest with the
+// objects rendered from the chart, reporting added, removed and modified
+// objects.
+func compareChart(released, rendered []manifestObject) (map[string][]string, error) {
+	drift := map[string][]string{}
+	renderedByKey := map[string]manifestObject{}
+	for _, o := range rendered {
+		renderedByKey[o.key()] = o
+	}
+	for _, o := range released {
+		r, ok := renderedByKey[o.key()]
+		if !ok {
+			drift[o.key()] = []string{"object is no longer part of the chart"}
+			continue
+		}
+		delete(renderedByKey, o.key())
+		want, err := normalize(r.Object)
+		if err != nil {
+			return nil, fmt.Errorf("normalize %s: %w", o.key(), err)
+		}
+		got, err := normalize(o.Object)
+		if err != nil {
+			return nil, fmt.Errorf("normalize %s: %w", o.key(), err)
+		}
+		var wantData, gotData map[string]interface{}
+		if o.isSecret() {
+			wantData, gotData = splitSecretData(want), splitSecretData(got)
+		}
+		differences := compareFields("", want, got, "chart", "release")
+		differences = append(differences, compareSecretData(wantData, gotData, "chart", "release")...)
+		// Also report fields which have been removed from the chart.
+		removed := compareFields("", got, want, "release", "chart")
+		removed = append(removed, compareSecretData(gotData, wantData, "release", "chart")...)
+		for _, d := range removed {
+			if strings.HasSuffix(d, ", chart <none>") {
+				differences = append(differences, d)
+			}
+		}
+		if len(differences) > 0 {
+			drift[o.key()] = differences
+		}
+	}
+	for k := range renderedByKey {
+		drift[k] = []string{"object is part of the chart but not of the release"}
+	}
+	return drift, nil
+}
+
+// valuesFlags returns the flags which influence the values used to render
+// a chart (--set, --set-string, --set-file, --values and -f) from flags.
+func valuesFlags(flags []string) []string {
+	valuesFlagNames := []string{"--set", "--set-string", "--set-file", "--values", "-f"}
+	selected := []string{}
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		name := strings.SplitN(f, "=", 2)[0]
+		if !containsString(valuesFlagNames, name) {
+			continue
+		}
+		selected = append(selected, f)
+		if name == f && i+1 < len(flags) {
+			selected = append(selected, flags[i+1])
+			i++
+		}
+	}
+	return selected
+}
+
+// compareDeployedChart compares the release manifest to the chart at the
+// commit from which the release has been deployed. If that is not the
+// checked out commit, the commit is checked out into a temporary git
+// worktree. If this is not possible, the reason is returned instead.
+func (d *deployHelm) compareDeployedChart(commit string, released []manifestObject) (map[string][]string, string, error) {
+	chartDir := d.opts.chartDir
+	valuesFiles := d.valuesFiles
+	if commit != d.ctxt.GitCommitSHA {
+		d.logger.Infof("Release has been deployed from commit %s, checking it out to render the chart ...", commit)
+		worktree, removeWorktree, err := d.addWorktree(commit)
+		if err != nil {
+			return nil, fmt.Sprintf("commit %s, from which the release has been deployed, cannot be checked out: %s", commit, err), nil
+		}
+		defer removeWorktree()
+		relChartDir, err := filepath.Rel(d.opts.checkoutDir, d.opts.chartDir)
+		if err != nil {
+			return nil, "", fmt.Errorf("locate chart in checkout: %w", err)
+		}
+		chartDir = filepath.Join(worktree, relChartDir)
+		if _, err := os.Stat(chartDir); os.IsNotExist(err) {
+			return nil, fmt.Sprintf("commit %s, from which the release has been deployed, has no chart in %s.", commit, relChartDir), nil
+		}
+		valuesFiles = []string{}
+		for _, vfc := range d.valuesFilesCandidates(chartDir) {
+			if _, err := os.Stat(vfc); err == nil {
+				valuesFiles = append(valuesFiles, vfc)
+			}
+		}
+	}
+	upgradeFlags, err := shlex.Split(d.opts.upgradeFlags)
+	if err != nil {
+		return nil, "", fmt.Errorf("parse upgrade flags (%s): %s", d.opts.upgradeFlags, err)
+	}
+	rendered, err := d.renderChart(chartDir, valuesFiles, commit, upgradeFlags)
+	if err != nil {
+		return nil, "", fmt.Errorf("render chart: %w", err)
+	}
+	renderedObjects, err := parseManifest(rendered)
+	if err != nil {
+		return nil, "", fmt.Errorf("parse rendered chart: %w", err)
+	}
+	diffs, err := compareChart(released, renderedObjects)
+	if err != nil {
+		return nil, "", fmt.Errorf("compare chart: %w", err)
+	}
+	return diffs, "", nil
+}
+
+// addWorktree checks out commit into a temporary git worktree of the
+// checkout. If the commit is not available (e.g. in a shallow clone), it is
+// fetched first. The returned function removes the worktree again.
+func (d *deployHelm) addWorktree(commit string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "deploy-helm-worktree-")
+	if err != nil {
+		return "", nil, fmt.Errorf("create worktree dir: %w", err)
+	}
+	remove := func() {
+		err := d.git("worktree", "remove", "--force", dir)
+		if err != nil {
+			d.logger.Warnf("Could not remove worktree %s: %s", dir, err)
+		}
+		os.RemoveAll(dir)
+	}
+	err = d.git("worktree", "add", "--detach", dir, commit)
+	if err != nil {
+		fetchErr := d.git("fetch", "--depth=1", "origin", commit)
+		if fetchErr != nil {
+			os.RemoveAll(dir)
+			return "", nil, fetchErr
+		}
+		err = d.git("worktree", "add", "--detach", dir, commit)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, remove, nil
+}
+
+// git runs git with given args in the checkout.
+func (d *deployHelm) git(args ...string) error {
+	var stdout, stderr bytes.Buffer
+	err := command.Run(gitBin, append([]string{"-C", d.opts.checkoutDir}, args...), []string{}, &stdout, &stderr)
+	if err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// renderChart renders the chart in chartDir with given values files as it
+// is deployed for given Git commit. The chart is packaged with the same version and app
+// version as when it is deployed so that labels such as helm.sh/chart match.
+func (d *deployHelm) renderChart(chartDir string, valuesFiles []string, gitCommitSHA string, upgradeFlags []string) (string, error) {
+	dir, err := os.MkdirTemp("", "deploy-helm-drift-")
+	if err != nil {
+		return "", fmt.Errorf("create package dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	helmArchive, err := packageHelmChart(chartDir, gitCommitSHA, dir, d.opts.debug)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"--namespace=" + d.releaseNamespace, "secrets", "template"}
+	args = append(args, d.commonHelmArgs()...)
+	args = append(args, "--no-hooks", fmt.Sprintf("--set=image.tag=%s", gitCommitSHA))
+	args = append(args, valuesFlags(upgradeFlags)...)
+	for _, vf := range valuesFiles {
+		args = append(args, fmt.Sprintf("--values=%s", vf))
+	}
+	args = append(args, d.releaseName, helmArchive)
+	printlnSafeHelmCmd(args, os.Stdout)
+	var stdout, stderr bytes.Buffer
+	err = command.RunRaw(d.helmBin, args, d.sopsEnv, &stdout, &stderr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
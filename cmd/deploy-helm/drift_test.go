@@ -0,0 +1,329 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const driftTestManifest = `---
+# Source: foo/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: ClusterIP
+  ports:
+    - port: 8080
+---
+# Source: foo/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+        - name: foo
+          image: foo:abc
+          resources:
+            limits:
+              memory: 1Gi
+`
+
+func TestParseManifest(t *testing.T) {
+	objects, err := parseManifest(driftTestManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, o.key())
+	}
+	if diff := cmp.Diff([]string{"Service/foo", "Deployment/foo"}, keys); diff != "" {
+		t.Fatalf("objects mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompareFields(t *testing.T) {
+	tests := map[string]struct {
+		want interface{}
+		got  interface{}
+		diff []string
+	}{
+		"equal with additional fields": {
+			want: map[string]interface{}{"spec": map[string]interface{}{"replicas": 2.0}},
+			got:  map[string]interface{}{"spec": map[string]interface{}{"replicas": 2.0, "paused": false}},
+			diff: nil,
+		},
+		"modified field": {
+			want: map[string]interface{}{"spec": map[string]interface{}{"replicas": 2.0}},
+			got:  map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0}},
+			diff: []string{"spec.replicas: release 2, live 3"},
+		},
+		"missing field": {
+			want: map[string]interface{}{"spec": map[string]interface{}{"type": "ClusterIP"}},
+			got:  map[string]interface{}{"spec": map[string]interface{}{}},
+			diff: []string{`spec.type: release "ClusterIP", live <none>`},
+		},
+		"list of different length": {
+			want: map[string]interface{}{"ports": []interface{}{1.0}},
+			got:  map[string]interface{}{"ports": []interface{}{1.0, 2.0}},
+			diff: []string{"ports: release [1], live [1,2]"},
+		},
+		"equal quantities": {
+			want: map[string]interface{}{"memory": "1Gi"},
+			got:  map[string]interface{}{"memory": "1024Mi"},
+			diff: nil,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := compareFields("", tc.want, tc.got, "release", "live")
+			if diff := cmp.Diff(tc.diff, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Fatalf("differences mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompareLive(t *testing.T) {
+	objects, err := parseManifest(driftTestManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveDeployment := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "foo", "namespace": "foo-dev"},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "foo",
+							"image": "foo:abc",
+							"resources": map[string]interface{}{
+								"limits": map[string]interface{}{"memory": "1024Mi"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	services := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deployments: "DeploymentList", services: "ServiceList"},
+		liveDeployment,
+	)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Service"}, meta.RESTScopeNamespace)
+
+	got, err := compareLive(client, mapper, "foo-dev", objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"Service/foo":    {"object has been deleted from the cluster"},
+		"Deployment/foo": {"spec.replicas: release 2, live 3"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("drift mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompareLiveSecrets(t *testing.T) {
+	objects, err := parseManifest(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: unchanged
+stringData:
+  password: s3cr3t
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: changed
+data:
+  password: czNjcjN0
+  token: dG9rZW4=
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := func(name string, data map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "foo-dev"},
+			"data":       data,
+		}}
+	}
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{secrets: "SecretList"},
+		secret("unchanged", map[string]interface{}{"password": "czNjcjN0"}),
+		secret("changed", map[string]interface{}{"password": "b3RoZXI="}),
+	)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+
+	got, err := compareLive(client, mapper, "foo-dev", objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"Secret/changed": {
+			"data.password: release and live values differ",
+			"data.token: release <set>, live <none>",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("drift mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompareChart(t *testing.T) {
+	released, err := parseManifest(driftTestManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := parseManifest(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  template:
+    spec:
+      containers:
+        - name: foo
+          image: foo:abc
+          resources:
+            limits:
+              memory: 1Gi
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := compareChart(released, rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"Service/foo":    {"object is no longer part of the chart"},
+		"Deployment/foo": {"spec.replicas: release 2, chart <none>"},
+		"ConfigMap/foo":  {"object is part of the chart but not of the release"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("drift mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValuesFlags(t *testing.T) {
+	got := valuesFlags([]string{"--install", "--set", "a=b", "--wait", "--values=v.yaml", "-f", "w.yaml", "--set-string=c=d", "--timeout=5m"})
+	want := []string{"--set", "a=b", "--values=v.yaml", "-f", "w.yaml", "--set-string=c=d"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("flags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDriftReportString(t *testing.T) {
+	report := newDriftReport()
+	report.live["Deployment/foo"] = []string{"spec.replicas: release 2, live 3"}
+	report.chartSkipped = "the chart depends on charts of subrepositories."
+	want := `Live cluster state compared to release manifest:
+  Deployment/foo:
+    spec.replicas: release 2, live 3
+
+Release manifest compared to chart:
+  Not compared: the chart depends on charts of subrepositories.
+
+`
+	if diff := cmp.Diff(want, report.String()); diff != "" {
+		t.Fatalf("report mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddWorktree(t *testing.T) {
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commitChart := func(version string) string {
+		err := os.MkdirAll(filepath.Join(repo, "chart"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(repo, "chart", "Chart.yaml"), []byte("version: "+version+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("commit", "-q", "-m", version)
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "-q")
+	deployed := commitChart("1.0.0")
+	commitChart("2.0.0")
+
+	d := &deployHelm{logger: testLogger(), opts: options{checkoutDir: repo}}
+	dir, remove, err := d.addWorktree(deployed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "chart", "Chart.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("version: 1.0.0\n", string(content)); diff != "" {
+		t.Fatalf("chart mismatch (-want +got):\n%s", diff)
+	}
+	remove()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("want worktree to be removed, got: %v", err)
+	}
+	if worktrees := git("worktree", "list"); strings.Count(worktrees, "\n") > 0 {
+		t.Fatalf("want only the main worktree, got:\n%s", worktrees)
+	}
+
+	// Commits which cannot be fetched are reported.
+	_, _, err = d.addWorktree("0000000000000000000000000000000000000000")
+	if err == nil {
+		t.Fatal("want err, got none")
+	}
+}
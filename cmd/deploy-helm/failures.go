@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+)
+
+// Classes of failed helm and skopeo commands.
+const (
+	classDrift             = "drift"
+	classPendingOperation  = "pending-operation"
+	classHelmTimeout       = "helm-timeout"
+	classNoDeployedRelease = "no-deployed-release"
+	classReleaseNotFound   = "release-not-found"
+	classUnauthorized      = "unauthorized"
+	classForbidden         = "forbidden"
+	classImageNotFound     = "image-not-found"
+	classCertificate       = "certificate"
+)
+
+// helmDiffClassification identifies detected drift, which helm-diff
+// signals with a dedicated exit code.
+var helmDiffClassification = command.Classification{
+	ExitCodes: map[int]string{diffDriftExitCode: classDrift},
+}
+
+// helmUpgradeClassification identifies common reasons for failed upgrades.
+var helmUpgradeClassification = command.Classification{
+	Messages: map[string]string{
+		"another operation (install/upgrade/rollback) is in progress": classPendingOperation,
+		"timed out waiting for the condition":                         classHelmTimeout,
+		"has no deployed releases":                                    classNoDeployedRelease,
+		"Unauthorized":                                                classUnauthorized,
+		"is forbidden":                                                classForbidden,
+	},
+}
+
+// helmReleaseClassification identifies releases which do not exist.
+var helmReleaseClassification = command.Classification{
+	Messages: map[string]string{
+		"release: not found": classReleaseNotFound,
+	},
+}
+
+// helmUninstallClassification additionally identifies releases which do not exist.
+var helmUninstallClassification = command.Classification{
+	Messages: mergeMaps(helmUpgradeClassification.Messages, helmReleaseClassification.Messages),
+}
+
+// skopeoClassification identifies common reasons for failed image copies.
+var skopeoClassification = command.Classification{
+	Messages: map[string]string{
+		"unauthorized":            classUnauthorized,
+		"authentication required": classUnauthorized,
+		"denied":                  classForbidden,
+		"manifest unknown":        classImageNotFound,
+		"x509":                    classCertificate,
+	},
+}
+
+// helmHints explains what to do about classified helm failures.
+var helmHints = map[string]string{
+	classPendingOperation:  "a previous operation on the release did not finish. Wait for it to complete, or roll back the release to its last deployed revision. Stale pending releases can be recovered automatically with -pending-release-policy",
+	classHelmTimeout:       "the release resources did not become ready in time. Check the release status artifact and the events of the pods, or increase the timeout via --timeout in the Helm flags",
+	classNoDeployedRelease: "all revisions of the release failed. Uninstall the release or roll it back before deploying again",
+	classUnauthorized:      "the token used to access the target cluster is invalid or expired. Check the API credentials of the target environment",
+	classForbidden:         "the service account lacks permissions in the release namespace. Check its role bindings",
+}
+
+// skopeoHints explains what to do about classified skopeo failures.
+var skopeoHints = map[string]string{
+	classUnauthorized:  "check the registry credentials of the target environment",
+	classForbidden:     "the service account is not allowed to push to the release namespace. Check the image-pusher role binding",
+	classImageNotFound: "the source image does not exist. Check that the image was built for the checked out commit",
+	classCertificate:   "the registry certificate could not be verified. Provide the CA certificate in the certificate directory or disable TLS verification of the registry",
+}
+
+// withHint adds the hint for the class of a failed command to err. Other
+// errors are returned unchanged.
+func withHint(err error, hints map[string]string) error {
+	var runErr *command.Error
+	if errors.As(err, &runErr) {
+		if hint, ok := hints[runErr.Result.Class]; ok {
+			return fmt.Errorf("%w (hint: %s)", err, hint)
+		}
+	}
+	return err
+}
+
+// isReleaseNotFound returns whether err is the failure of a Helm command
+// operating on a release which does not exist.
+func isReleaseNotFound(err error) bool {
+	var runErr *command.Error
+	return errors.As(err, &runErr) && runErr.Result.Class == classReleaseNotFound
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/shlex"
 	"github.com/opendevstack/ods-pipeline-helm/internal/command"
@@ -33,31 +38,154 @@ type helmChart struct {
 	Version string `json:"version"`
 }
 
+// helmRevision is an entry of "helm history -o json".
+type helmRevision struct {
+	Revision    int       `json:"revision"`
+	Updated     time.Time `json:"updated"`
+	Status      string    `json:"status"`
+	Chart       string    `json:"chart"`
+	AppVersion  string    `json:"app_version"`
+	Description string    `json:"description"`
+}
+
 // helmDiff runs the diff and returns whether the Helm release is in sync.
 // An error is returned when the diff cannot be started or encounters failures
 // unrelated to drift (such as invalid resource manifests).
 func (d *deployHelm) helmDiff(args []string, outWriter, errWriter io.Writer) (bool, error) {
-	return command.RunWithSpecialFailureCode(
-		d.helmBin, args, []string{
-			fmt.Sprintf("SOPS_AGE_KEY_FILE=%s", ageKeyFilePath),
+	result, err := command.RunContext(context.TODO(), d.helmBin, args, command.Options{
+		Env: append([]string{
 			"HELM_DIFF_IGNORE_UNKNOWN_FLAGS=true", // https://github.com/databus23/helm-diff/issues/278
-		}, outWriter, errWriter, diffDriftExitCode,
-	)
+		}, d.sopsEnv...),
+		Stdout:         outWriter,
+		Stderr:         errWriter,
+		Classification: helmDiffClassification,
+	})
+	if err != nil {
+		if result.Class == classDrift {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 // helmUpgrade runs given Helm command.
 func (d *deployHelm) helmUpgrade(args []string, stdout, stderr io.Writer) error {
-	return command.Run(
-		d.helmBin, args, []string{fmt.Sprintf("SOPS_AGE_KEY_FILE=%s", ageKeyFilePath)}, stdout, stderr,
-	)
+	_, err := command.RunContext(context.TODO(), d.helmBin, args, command.Options{
+		Env:            d.sopsEnv,
+		Stdout:         stdout,
+		Stderr:         stderr,
+		Classification: helmUpgradeClassification,
+	})
+	return withHint(err, helmHints)
 }
 
-// helmStatus runs given Helm command.
+// helmRollback rolls the release back to given revision (0 rolls back to
+// the previous revision).
+func (d *deployHelm) helmRollback(revision int, flags string, stdout, stderr io.Writer) error {
+	rollbackFlags, err := shlex.Split(flags)
+	if err != nil {
+		return fmt.Errorf("parse rollback flags (%s): %s", flags, err)
+	}
+	args := append([]string{"-n", d.releaseNamespace}, d.commonHelmArgs()...)
+	args = append(args, "rollback", d.releaseName)
+	if revision > 0 {
+		args = append(args, strconv.Itoa(revision))
+	}
+	args = append(args, rollbackFlags...)
+	printlnSafeHelmCmd(args, stdout)
+	_, err = command.RunContext(context.TODO(), d.helmBin, args, command.Options{
+		Stdout:         stdout,
+		Stderr:         stderr,
+		Classification: helmUpgradeClassification,
+	})
+	return withHint(err, helmHints)
+}
+
+// helmUninstall uninstalls the release.
+func (d *deployHelm) helmUninstall(flags string, stdout, stderr io.Writer) error {
+	uninstallFlags, err := shlex.Split(flags)
+	if err != nil {
+		return fmt.Errorf("parse uninstall flags (%s): %s", flags, err)
+	}
+	args := append([]string{"-n", d.releaseNamespace}, d.commonHelmArgs()...)
+	args = append(args, "uninstall", d.releaseName)
+	args = append(args, uninstallFlags...)
+	printlnSafeHelmCmd(args, stdout)
+	_, err = command.RunContext(context.TODO(), d.helmBin, args, command.Options{
+		Stdout:         stdout,
+		Stderr:         stderr,
+		Classification: helmUninstallClassification,
+	})
+	return withHint(err, helmHints)
+}
+
+// helmStatus runs given Helm command. Stdout is not redacted as it is
+// parsed by the caller.
 func (d *deployHelm) helmStatus(args []string, stdout, stderr io.Writer) error {
 	baseArgs := []string{"-n", d.releaseNamespace}
 	baseArgs = append(baseArgs, d.commonHelmArgs()...)
 	baseArgs = append(baseArgs, "status")
-	return command.Run(helmBin, append(baseArgs, args...), []string{}, stdout, stderr)
+	return command.RunRaw(helmBin, append(baseArgs, args...), []string{}, stdout, stderr)
+}
+
+// releaseRevision returns the current revision of the release.
+func (d *deployHelm) releaseRevision() (*helmRevision, error) {
+	history, err := d.releaseHistory(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("release %s has no revisions", d.releaseName)
+	}
+	return &history[len(history)-1], nil
+}
+
+// releaseHistory returns the last max revisions of the release, oldest first.
+func (d *deployHelm) releaseHistory(max int) ([]helmRevision, error) {
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"-n", d.releaseNamespace}, d.commonHelmArgs()...)
+	args = append(args, "history", d.releaseName, fmt.Sprintf("--max=%d", max), "-o", "json")
+	_, err := command.RunContext(context.TODO(), d.helmBin, args, command.Options{
+		Stdout:         &stdout,
+		Stderr:         &stderr,
+		RawStdout:      true,
+		Classification: helmReleaseClassification,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var history []helmRevision
+	err = json.Unmarshal(stdout.Bytes(), &history)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal history: %w", err)
+	}
+	return history, nil
+}
+
+// releaseManifest returns the manifest of the current revision of the release.
+// The manifest is not redacted, callers must redact what they print or store.
+func (d *deployHelm) releaseManifest() (string, error) {
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"-n", d.releaseNamespace}, d.commonHelmArgs()...)
+	args = append(args, "get", "manifest", d.releaseName)
+	err := command.RunRaw(d.helmBin, args, []string{}, &stdout, &stderr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// releaseNotes returns the notes of given revision of the release.
+func (d *deployHelm) releaseNotes(revision int) (string, error) {
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"-n", d.releaseNamespace}, d.commonHelmArgs()...)
+	args = append(args, "get", "notes", d.releaseName, fmt.Sprintf("--revision=%d", revision))
+	err := command.Run(d.helmBin, args, []string{}, &stdout, &stderr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
 }
 
 // assembleHelmDiffArgs creates a slice of arguments for "helm diff upgrade".
@@ -118,16 +246,8 @@ func (d *deployHelm) commonHelmArgs() (args []string) {
 	if d.opts.debug {
 		args = append([]string{"--debug"}, args...)
 	}
-	if d.targetConfig.APIServer != "" {
-		args = append(
-			[]string{
-				fmt.Sprintf("--kube-apiserver=%s", d.targetConfig.APIServer),
-				fmt.Sprintf("--kube-token=%s", d.targetConfig.APIToken),
-			},
-			args...,
-		)
-	}
-	return args
+	args = append(d.kubeconfigHelmArgs(), args...)
+	return append(d.targetHelmArgs(), args...)
 }
 
 // getHelmChart reads given filename into a helmChart struct.
@@ -175,8 +295,9 @@ func printlnSafeHelmCmd(args []string, outWriter io.Writer) {
 	fmt.Fprintln(outWriter, helmBin, strings.Join(safeArgs, " "))
 }
 
-// packageHelmChart creates a Helm package for given chart.
-func packageHelmChart(chartDir, gitCommitSHA string, debug bool) (string, error) {
+// packageHelmChart creates a Helm package for given chart. The package is
+// written into destDir, or into the current directory if destDir is empty.
+func packageHelmChart(chartDir, gitCommitSHA, destDir string, debug bool) (string, error) {
 	hc, err := getHelmChart(filepath.Join(chartDir, "Chart.yaml"))
 	if err != nil {
 		return "", fmt.Errorf("read chart: %w", err)
@@ -187,6 +308,9 @@ func packageHelmChart(chartDir, gitCommitSHA string, debug bool) (string, error)
 		fmt.Sprintf("--app-version=%s", gitCommitSHA),
 		fmt.Sprintf("--version=%s", packageVersion),
 	}
+	if destDir != "" {
+		helmPackageArgs = append(helmPackageArgs, fmt.Sprintf("--destination=%s", destDir))
+	}
 	if debug {
 		helmPackageArgs = append(helmPackageArgs, "--debug")
 	}
@@ -196,5 +320,5 @@ func packageHelmChart(chartDir, gitCommitSHA string, debug bool) (string, error)
 	}
 
 	helmArchive := fmt.Sprintf("%s-%s.tgz", hc.Name, packageVersion)
-	return helmArchive, nil
+	return filepath.Join(destDir, helmArchive), nil
 }
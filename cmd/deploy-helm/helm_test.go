@@ -297,3 +297,33 @@ func TestPrintlnSafeHelmCmd(t *testing.T) {
 		t.Fatalf("want: '%s', got: '%s'", want, got)
 	}
 }
+
+func TestHelmUpgradeHint(t *testing.T) {
+	tests := map[string]struct {
+		stderr   string
+		wantHint bool
+	}{
+		"pending operation": {
+			stderr:   "'Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress'",
+			wantHint: true,
+		},
+		"unknown failure": {
+			stderr:   "'Error: UPGRADE FAILED: something went wrong'",
+			wantHint: false,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			d := &deployHelm{helmBin: "../../test/scripts/exit-with-code.sh"}
+			err := d.helmUpgrade([]string{"", tc.stderr, "1"}, &stdout, &stderr)
+			if err == nil {
+				t.Fatal("want err, got none")
+			}
+			gotHint := strings.Contains(err.Error(), "hint: "+helmHints[classPendingOperation])
+			if gotHint != tc.wantHint {
+				t.Fatalf("want hint=%v, got error %q", tc.wantHint, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keyProvider makes a decryption key available to helm-secrets (sops).
+type keyProvider interface {
+	// name identifies the provider in log messages.
+	name() string
+	// configured returns whether the provider has been requested via options.
+	configured(opts options) bool
+	// importKey reads the key and returns the environment variables
+	// which point sops to it. If the key is not available, imported is false.
+	importKey(d *deployHelm) (env []string, imported bool, err error)
+}
+
+// keyProviders lists all supported key providers.
+var keyProviders = []keyProvider{
+	&ageKeyProvider{},
+	&pgpKeyProvider{},
+	&vaultKeyProvider{},
+}
+
+// keySecret retrieves the secret identified by name from the pipeline
+// namespace. If the secret does not exist, nil is returned without error.
+func (d *deployHelm) keySecret(name string) (*corev1.Secret, error) {
+	secret, err := d.clientset.CoreV1().Secrets(d.ctxt.Namespace).Get(
+		context.TODO(), name, metav1.GetOptions{},
+	)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return secret, nil
+}
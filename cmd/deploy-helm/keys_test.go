@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/logging"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImportKeys(t *testing.T) {
+	tests := map[string]struct {
+		opts    options
+		secrets []corev1.Secret
+		wantEnv []string
+		wantErr bool
+	}{
+		"no provider configured": {
+			opts:    options{},
+			wantEnv: []string{},
+		},
+		"secret not present": {
+			opts:    options{vaultTokenSecret: "vault", vaultTokenSecretField: "token"},
+			wantEnv: []string{},
+		},
+		"vault token": {
+			opts: options{vaultTokenSecret: "vault", vaultTokenSecretField: "token", vaultAddr: "https://vault.example.com"},
+			secrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "vault", Namespace: "foo-cd"},
+					Data:       map[string][]byte{"token": []byte("s3cr3t\n")},
+				},
+			},
+			wantEnv: []string{"VAULT_TOKEN=s3cr3t", "VAULT_ADDR=https://vault.example.com"},
+		},
+		"vault token field empty": {
+			opts: options{vaultTokenSecret: "vault", vaultTokenSecretField: "other"},
+			secrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "vault", Namespace: "foo-cd"},
+					Data:       map[string][]byte{"token": []byte("s3cr3t")},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			for i := range tc.secrets {
+				_, err := clientset.CoreV1().Secrets(tc.secrets[i].Namespace).Create(
+					context.TODO(), &tc.secrets[i], metav1.CreateOptions{},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := &deployHelm{
+				logger:    testLogger(),
+				opts:      tc.opts,
+				clientset: clientset,
+				ctxt:      &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+			}
+			d, err := importKeys()(d)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.wantEnv, d.sopsEnv); diff != "" {
+				t.Fatalf("env mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func testLogger() logging.LeveledLoggerInterface {
+	return &logging.LeveledLogger{Level: logging.LevelNull}
+}
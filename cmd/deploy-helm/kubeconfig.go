@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newPipelineRestConfig returns the config to access the cluster the
+// pipeline runs in, together with the namespace of the selected kubeconfig
+// context (empty when running in-cluster).
+//
+// If neither kubeconfig nor kubeContext is given, the in-cluster config is
+// used when running in a pod. Otherwise, the kubeconfig is loaded following
+// the kubectl rules: the given file, $KUBECONFIG or ~/.kube/config.
+func newPipelineRestConfig(kubeconfig, kubeContext string) (*rest.Config, string, error) {
+	if kubeconfig == "" && kubeContext == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, "", nil
+		}
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, "", err
+		}
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("load kubeconfig: %w", err)
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("namespace of kubeconfig context: %w", err)
+	}
+	return config, namespace, nil
+}
+
+// kubeconfigHelmArgs returns the arguments selecting the kubeconfig and
+// context for Helm. They are not needed when the target API server is
+// configured explicitly.
+func (d *deployHelm) kubeconfigHelmArgs() (args []string) {
+	if d.targetConfig.APIServer != "" {
+		return nil
+	}
+	if d.opts.kubeconfig != "" {
+		args = append(args, fmt.Sprintf("--kubeconfig=%s", d.opts.kubeconfig))
+	}
+	if d.opts.kubeContext != "" {
+		args = append(args, fmt.Sprintf("--kube-context=%s", d.opts.kubeContext))
+	}
+	return args
+}
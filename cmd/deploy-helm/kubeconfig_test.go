@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: other
+  cluster:
+    server: https://other.example.com:6443
+users:
+- name: dev
+  user:
+    token: s3cr3t
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: dev
+    namespace: foo-cd
+- name: other
+  context:
+    cluster: other
+    user: dev
+current-context: kind
+`
+
+func TestNewPipelineRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeconfig, []byte(testKubeconfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		kubeContext   string
+		wantHost      string
+		wantNamespace string
+	}{
+		"current context": {
+			wantHost:      "https://127.0.0.1:6443",
+			wantNamespace: "foo-cd",
+		},
+		"selected context": {
+			kubeContext:   "other",
+			wantHost:      "https://other.example.com:6443",
+			wantNamespace: "default",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, namespace, err := newPipelineRestConfig(kubeconfig, tc.kubeContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.wantHost, config.Host); diff != "" {
+				t.Fatalf("host mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("s3cr3t", config.BearerToken); diff != "" {
+				t.Fatalf("token mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantNamespace, namespace); diff != "" {
+				t.Fatalf("namespace mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unknown context", func(t *testing.T) {
+		_, _, err := newPipelineRestConfig(kubeconfig, "missing")
+		if err == nil {
+			t.Fatal("want err, got none")
+		}
+	})
+}
+
+func TestKubeconfigHelmArgs(t *testing.T) {
+	tests := map[string]struct {
+		opts         options
+		targetConfig *targetEnvironment
+		want         []string
+	}{
+		"in-cluster": {
+			targetConfig: &targetEnvironment{},
+			want:         nil,
+		},
+		"kubeconfig and context": {
+			opts:         options{kubeconfig: "/tmp/config", kubeContext: "kind"},
+			targetConfig: &targetEnvironment{},
+			want:         []string{"--kubeconfig=/tmp/config", "--kube-context=kind"},
+		},
+		"explicit API server": {
+			opts:         options{kubeconfig: "/tmp/config", kubeContext: "kind"},
+			targetConfig: &targetEnvironment{APIServer: "https://api.example.com"},
+			want:         nil,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := &deployHelm{opts: tc.opts, targetConfig: tc.targetConfig}
+			if diff := cmp.Diff(tc.want, d.kubeconfigHelmArgs()); diff != "" {
+				t.Fatalf("args mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	// releaseLockPrefix is the prefix of the Lease locking a release.
+	releaseLockPrefix = "ods-helm-lock"
+	// releaseLockDuration is how long a lock is valid without being renewed.
+	// Locks of pipeline runs which were killed expire after this duration.
+	releaseLockDuration = 2 * time.Minute
+	// releaseLockPollInterval is the interval in which a held lock is checked.
+	releaseLockPollInterval = 5 * time.Second
+)
+
+// releaseLock is a Lease in the release namespace held by one pipeline run
+// while it operates on the release.
+type releaseLock struct {
+	leases coordinationv1client.LeaseInterface
+	name   string
+	holder string
+	// Stops renewing the lock.
+	stopRenew context.CancelFunc
+	renewDone chan struct{}
+}
+
+// releaseLockName returns the name of the Lease locking given release.
+func releaseLockName(releaseName string) string {
+	return fmt.Sprintf("%s-%s", releaseLockPrefix, releaseName)
+}
+
+// lockRelease acquires the lock of the release, waiting for other pipeline
+// runs holding it. The lock is released once all steps are done. If the
+// namespace does not exist yet or Leases cannot be managed in it, the
+// release is not locked.
+func lockRelease() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.releaseLock || d.opts.diffOnly {
+			return d, nil
+		}
+		err := d.acquireLock()
+		if apierrors.IsNotFound(err) {
+			d.logger.Warnf("Namespace %s does not exist, continuing without release lock.", d.releaseNamespace)
+			return d, nil
+		}
+		if apierrors.IsForbidden(err) {
+			d.logger.Warnf(
+				"Not allowed to manage Leases in namespace %s, continuing without release lock. "+
+					"Grant get, create, update and delete on leases.coordination.k8s.io, or disable the release lock.",
+				d.releaseNamespace,
+			)
+			return d, nil
+		}
+		if err != nil {
+			return d, fmt.Errorf("lock release %s: %w", d.releaseName, err)
+		}
+		d.addCleanup(func() {
+			if d.lock == nil {
+				return
+			}
+			err := d.lock.release()
+			if err != nil {
+				d.logger.Warnf("Could not release lock %s: %s", d.lock.name, err)
+			}
+		})
+		return d, nil
+	}
+}
+
+// acquireLock acquires the lock of the release and keeps renewing it until
+// it is released.
+func (d *deployHelm) acquireLock() error {
+	lock, err := acquireReleaseLock(
+		d.targetClientset.CoordinationV1().Leases(d.releaseNamespace),
+		releaseLockName(d.releaseName), d.lockHolder(),
+		releaseLockPollInterval, d.opts.releaseLockTimeout, d.logger.Infof,
+	)
+	if err != nil {
+		return err
+	}
+	lock.renew(releaseLockDuration/3, d.logger.Warnf)
+	d.lock = lock
+	return nil
+}
+
+// unlockWhile releases the lock of the release while fn runs, so that other
+// pipeline runs are not blocked while fn waits (e.g. for an approval), and
+// acquires it again afterwards. As another pipeline run may have changed
+// the release in the meantime, an error is returned if the revision of the
+// release is no longer the same.
+func (d *deployHelm) unlockWhile(fn func() error) error {
+	if d.lock == nil {
+		return fn()
+	}
+	before, err := d.currentRevision()
+	if err != nil {
+		return err
+	}
+	name := d.lock.name
+	d.logger.Infof("Releasing lock %s while waiting.", name)
+	err = d.lock.release()
+	d.lock = nil
+	if err != nil {
+		d.logger.Warnf("Could not release lock %s: %s", name, err)
+	}
+	err = fn()
+	if err != nil {
+		return err
+	}
+	err = d.acquireLock()
+	if err != nil {
+		return fmt.Errorf("lock release %s: %w", d.releaseName, err)
+	}
+	after, err := d.currentRevision()
+	if err != nil {
+		return err
+	}
+	if after != before {
+		return fmt.Errorf(
+			"release %s has been changed by another pipeline run while waiting (revision %d, was %d), rerun to diff the release again",
+			d.releaseName, after, before,
+		)
+	}
+	return nil
+}
+
+// currentRevision returns the number of the current revision of the
+// release, or 0 if the release does not exist.
+func (d *deployHelm) currentRevision() (int, error) {
+	revision, err := d.releaseRevision()
+	if isReleaseNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get release revision: %w", err)
+	}
+	return revision.Revision, nil
+}
+
+// lockHolder identifies the pipeline run holding the lock. Without a known
+// pipeline run, the hostname (which is the pod name in a cluster) is used.
+func (d *deployHelm) lockHolder() string {
+	run := d.opts.pipelineRun
+	if run == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		run = hostname
+	}
+	return fmt.Sprintf("%s/%s", d.ctxt.Namespace, run)
+}
+
+// acquireReleaseLock acquires the Lease name for holder. If another holder
+// has the lock, it checks every interval whether the lock was released or
+// expired, until timeout is exceeded.
+func acquireReleaseLock(leases coordinationv1client.LeaseInterface, name, holder string, interval, timeout time.Duration, logf func(format string, args ...interface{})) (*releaseLock, error) {
+	lock := &releaseLock{leases: leases, name: name, holder: holder}
+	var currentHolder string
+	err := wait.PollUntilContextTimeout(context.TODO(), interval, timeout, true, func(ctx context.Context) (bool, error) {
+		acquired, lease, err := lock.tryAcquire(ctx, time.Now())
+		if err != nil || acquired {
+			return acquired, err
+		}
+		if lease != nil && *lease.Spec.HolderIdentity != currentHolder {
+			currentHolder = *lease.Spec.HolderIdentity
+			since := "unknown time"
+			if lease.Spec.AcquireTime != nil {
+				since = lease.Spec.AcquireTime.UTC().Format(time.RFC3339)
+			}
+			logf("Release is locked by pipeline run %s (since %s), waiting up to %s ...", currentHolder, since, timeout)
+		}
+		return false, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return nil, fmt.Errorf("lock %s still held by pipeline run %s after %s", name, currentHolder, timeout)
+		}
+		return nil, err
+	}
+	logf("Acquired release lock %s.", name)
+	return lock, nil
+}
+
+// tryAcquire creates the Lease, or takes it over if it is free, expired or
+// already held by l.holder. If the Lease is held by someone else, it is
+// returned.
+func (l *releaseLock) tryAcquire(ctx context.Context, now time.Time) (bool, *coordinationv1.Lease, error) {
+	lease, err := l.leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: l.name,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "ods-pipeline-helm",
+				},
+			},
+		}
+		l.hold(lease, now)
+		_, err = l.leases.Create(ctx, lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil, nil
+		}
+		return err == nil, nil, err
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if !l.isHeldBy(lease) && !leaseExpired(lease, now) {
+		return false, lease, nil
+	}
+	l.hold(lease, now)
+	_, err = l.leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil, nil
+	}
+	return err == nil, nil, err
+}
+
+func (l *releaseLock) hold(lease *coordinationv1.Lease, now time.Time) {
+	holder := l.holder
+	duration := int32(releaseLockDuration.Seconds())
+	t := metav1.NewMicroTime(now)
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &t
+	lease.Spec.RenewTime = &t
+}
+
+func (l *releaseLock) isHeldBy(lease *coordinationv1.Lease) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == l.holder
+}
+
+// leaseExpired returns whether the lease is free or has not been renewed
+// within its duration.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
+
+// renew renews the lock every interval until it is released.
+func (l *releaseLock) renew(interval time.Duration, warnf func(format string, args ...interface{})) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.stopRenew = cancel
+	l.renewDone = make(chan struct{})
+	go func() {
+		defer close(l.renewDone)
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			lease, err := l.leases.Get(ctx, l.name, metav1.GetOptions{})
+			if err == nil {
+				if !l.isHeldBy(lease) {
+					err = errors.New("lock has been taken over")
+				} else {
+					t := metav1.NewMicroTime(time.Now())
+					lease.Spec.RenewTime = &t
+					_, err = l.leases.Update(ctx, lease, metav1.UpdateOptions{})
+				}
+			}
+			if err != nil && ctx.Err() == nil {
+				warnf("Could not renew release lock %s: %s", l.name, err)
+			}
+		}, interval)
+	}()
+}
+
+// release stops renewing the lock and deletes the Lease, unless it has been
+// taken over by another holder in the meantime.
+func (l *releaseLock) release() error {
+	if l.stopRenew != nil {
+		l.stopRenew()
+		<-l.renewDone
+	}
+	ctx := context.TODO()
+	lease, err := l.leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !l.isHeldBy(lease) {
+		return nil
+	}
+	err = l.leases.Delete(ctx, l.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAcquireReleaseLock(t *testing.T) {
+	lease := func(holder string, renewed time.Time) *coordinationv1.Lease {
+		duration := int32(releaseLockDuration.Seconds())
+		renewTime := metav1.NewMicroTime(renewed)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "ods-helm-lock-app", Namespace: "foo-dev"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+	}
+	tests := map[string]struct {
+		existing   []runtime.Object
+		wantErr    string
+		wantLogged string
+	}{
+		"free": {},
+		"held by same pipeline run": {
+			existing: []runtime.Object{lease("foo-cd/run-1", time.Now())},
+		},
+		"expired": {
+			existing: []runtime.Object{lease("foo-cd/run-2", time.Now().Add(-time.Hour))},
+		},
+		"held by other pipeline run": {
+			existing:   []runtime.Object{lease("foo-cd/run-2", time.Now())},
+			wantErr:    "still held by pipeline run foo-cd/run-2",
+			wantLogged: "locked by pipeline run foo-cd/run-2",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tc.existing...)
+			leases := clientset.CoordinationV1().Leases("foo-dev")
+			var logged strings.Builder
+			logf := func(format string, args ...interface{}) {
+				fmt.Fprintf(&logged, format+"\n", args...)
+			}
+			lock, err := acquireReleaseLock(leases, "ods-helm-lock-app", "foo-cd/run-1", 10*time.Millisecond, 50*time.Millisecond, logf)
+			if !strings.Contains(logged.String(), tc.wantLogged) {
+				t.Fatalf("want log to contain %q, got %q", tc.wantLogged, logged.String())
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := leases.Get(context.TODO(), "ods-helm-lock-app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got.Spec.HolderIdentity != "foo-cd/run-1" {
+				t.Fatalf("want lock held by foo-cd/run-1, got %s", *got.Spec.HolderIdentity)
+			}
+			err = lock.release()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = leases.Get(context.TODO(), "ods-helm-lock-app", metav1.GetOptions{})
+			if !apierrors.IsNotFound(err) {
+				t.Fatalf("want lease to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReleaseLockTakenOver(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	leases := clientset.CoordinationV1().Leases("foo-dev")
+	lock, err := acquireReleaseLock(leases, "ods-helm-lock-app", "foo-cd/run-1", time.Millisecond, time.Second, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := leases.Get(context.TODO(), "ods-helm-lock-app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "foo-cd/run-2"
+	lease.Spec.HolderIdentity = &other
+	_, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lock.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = leases.Get(context.TODO(), "ods-helm-lock-app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("want lease of other holder to be kept, got %v", err)
+	}
+}
+
+func TestUnlockWhile(t *testing.T) {
+	tests := map[string]struct {
+		// Revision of the release after waiting.
+		revisionAfter int
+		wantErr       string
+	}{
+		"release unchanged": {
+			revisionAfter: 3,
+		},
+		"release changed by other pipeline run": {
+			revisionAfter: 4,
+			wantErr:       "has been changed by another pipeline run while waiting (revision 4, was 3)",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Fake helm binary printing the release history.
+			dir := t.TempDir()
+			historyFile := filepath.Join(dir, "history.json")
+			writeHistory := func(revision int) {
+				err := os.WriteFile(historyFile, []byte(fmt.Sprintf(`[{"revision":%d,"status":"deployed"}]`, revision)), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeHistory(3)
+			helmScript := filepath.Join(dir, "helm")
+			err := os.WriteFile(helmScript, []byte("#!/bin/sh\ncat "+historyFile+"\n"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientset := fake.NewSimpleClientset()
+			d := &deployHelm{
+				logger:           testLogger(),
+				helmBin:          helmScript,
+				opts:             options{releaseLockTimeout: time.Second, pipelineRun: "run-1"},
+				releaseName:      "app",
+				releaseNamespace: "foo-dev",
+				targetConfig:     &targetEnvironment{},
+				targetClientset:  clientset,
+				ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+			}
+			err = d.acquireLock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if d.lock != nil {
+					_ = d.lock.release()
+				}
+			}()
+
+			err = d.unlockWhile(func() error {
+				// Another pipeline run can take the lock while waiting.
+				leases := clientset.CoordinationV1().Leases("foo-dev")
+				other, err := acquireReleaseLock(leases, "ods-helm-lock-app", "foo-cd/run-2", 10*time.Millisecond, 50*time.Millisecond, t.Logf)
+				if err != nil {
+					return fmt.Errorf("other pipeline run: %w", err)
+				}
+				writeHistory(tc.revisionAfter)
+				return other.release()
+			})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lease, err := clientset.CoordinationV1().Leases("foo-dev").Get(context.TODO(), "ods-helm-lock-app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *lease.Spec.HolderIdentity != "foo-cd/run-1" {
+				t.Fatalf("want lock held by foo-cd/run-1 again, got %s", *lease.Spec.HolderIdentity)
+			}
+		})
+	}
+}
+
+func TestLockReleaseForbidden(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "ods-helm-lock-app", nil)
+	})
+	d := &deployHelm{
+		logger:           testLogger(),
+		opts:             options{releaseLock: true, releaseLockTimeout: time.Second},
+		releaseName:      "app",
+		releaseNamespace: "foo-dev",
+		targetClientset:  clientset,
+		ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+	}
+	_, err := lockRelease()(d)
+	if err != nil {
+		t.Fatalf("want deployment to continue without lock, got %s", err)
+	}
+	if d.lock != nil {
+		t.Fatal("want no lock to be held")
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"flag"
 	"io/fs"
 	"os"
+	"time"
 
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
 	"github.com/opendevstack/ods-pipeline/pkg/logging"
 	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
@@ -20,8 +23,17 @@ type options struct {
 	apiCredentialsSecret string
 	// API server of the target cluster, including scheme.
 	apiServer string
+	// Whether to skip TLS verification of the API server of the target cluster.
+	apiInsecureSkipTLSVerify bool
 	// Target K8s namespace (or OpenShift project) to deploy into.
 	namespace string
+	// Path of the kubeconfig file used outside of the cluster.
+	kubeconfig string
+	// Context of the kubeconfig to use.
+	kubeContext string
+	// Namespace the pipeline runs in. Defaults to the namespace of the ODS
+	// context, or the namespace of the kubeconfig context.
+	pipelineNamespace string
 	// Hostname of the target registry to push images to.
 	registryHost string
 	// Location of checkout directory.
@@ -34,10 +46,23 @@ type options struct {
 	diffFlags string
 	// Flags to pass to `helm upgrade`.
 	upgradeFlags string
-	// Name of K8s secret holding the age key.
+	// Comma separated names of K8s secrets holding age keys.
 	ageKeySecret string
-	// Field name within the K8s secret holding the age key.
+	// Field name within the K8s secrets holding the age key. "*" selects all fields.
 	ageKeySecretField string
+	// Whitespace separated entries of the form "namespace=secret[,secret...]"
+	// selecting the K8s secrets holding age keys per target namespace.
+	ageKeySecretsPerNamespace string
+	// Name of K8s secret holding the armored PGP private key.
+	pgpKeySecret string
+	// Field name within the K8s secret holding the PGP private key.
+	pgpKeySecretField string
+	// Name of K8s secret holding the Vault token.
+	vaultTokenSecret string
+	// Field name within the K8s secret holding the Vault token.
+	vaultTokenSecretField string
+	// Address of the Vault server, including scheme.
+	vaultAddr string
 	// Location of the certificate directory.
 	certDir string
 	// Whether to TLS verify the source image registry.
@@ -46,6 +71,88 @@ type options struct {
 	diffOnly bool
 	// Whether to gather the Helm release status.
 	gatherStatus bool
+	// Whether detected drift needs to be approved before upgrading.
+	requireApproval bool
+	// How long to wait for the approval of detected drift.
+	approvalTimeout time.Duration
+	// Location of the readiness checks file. Defaults to readiness-checks.yaml
+	// in the chart directory.
+	readinessChecksFile string
+	// Interval in which to report the rollout progress during the upgrade (0 disables it).
+	progressInterval time.Duration
+	// Lowest change class requiring approval.
+	approvalThreshold string
+	// Action to take when destructive changes are detected (allow, stop or fail).
+	onDestructiveChange string
+	// Path of the Tekton result file to write the change class to.
+	changeClassResultPath string
+	// Path of the Tekton result file to write the release namespace to.
+	releaseNamespaceResultPath string
+	// Path of the Tekton result file to write whether an upgrade happened to.
+	upgradedResultPath string
+	// Path of the Tekton result file to write the release revision to.
+	revisionResultPath string
+	// Path of the Tekton result file to write the release status to.
+	statusResultPath string
+	// Path of the Tekton result file to write whether images were promoted to.
+	imagesPromotedResultPath string
+	// Whether to only check the deployed release for drift, without packaging
+	// or upgrading anything.
+	driftCheck bool
+	// Path of the Tekton result file to write whether drift was detected to.
+	driftDetectedResultPath string
+	// Revision to roll back to (0 rolls back to the previous revision).
+	rollbackRevision int
+	// Flags to pass to `helm rollback`.
+	rollbackFlags string
+	// Flags to pass to `helm uninstall`.
+	uninstallFlags string
+	// Whether to tear down the release instead of deploying it.
+	teardown bool
+	// Whether to delete the image tags promoted into the release namespace on teardown.
+	deleteImages bool
+	// Whether to delete the release namespace on teardown.
+	deleteNamespace bool
+	// Whether to only report what the teardown would remove.
+	dryRun bool
+	// How to recover a release stuck in a pending state (none, rollback or mark-failed).
+	pendingReleasePolicy string
+	// How long a release must be pending before it is recovered.
+	pendingReleaseThreshold time.Duration
+	// Whether to lock the release while operating on it.
+	releaseLock bool
+	// How long to wait for the release lock held by another pipeline run.
+	releaseLockTimeout time.Duration
+	// Name of the pipeline run, recorded as holder of the release lock.
+	pipelineRun string
+	// Whether to check connectivity and permissions before doing any work.
+	preflight bool
+	// Whether to create the release namespace if it does not exist, and
+	// apply the namespace labels, annotations, quota and image puller binding.
+	ensureNamespace bool
+	// Whitespace separated key=value labels of the release namespace.
+	namespaceLabels string
+	// Whitespace separated key=value annotations of the release namespace.
+	namespaceAnnotations string
+	// File holding a ResourceQuota to apply to the release namespace.
+	resourceQuotaFile string
+	// File holding a LimitRange to apply to the release namespace.
+	limitRangeFile string
+	// ClusterRole bound to the pipeline service account in the release
+	// namespace to pull images. Empty disables the binding.
+	imagePullerClusterRole string
+	// Name of the service account the pipeline runs as.
+	pipelineServiceAccount string
+	// Whether to deploy into a preview environment.
+	preview bool
+	// Template of the preview namespace, rendered with the ODS context.
+	previewNamespaceTemplate string
+	// Template of the preview release name, rendered with the ODS context.
+	previewReleaseTemplate string
+	// How long a preview environment is kept after its last deployment.
+	previewTTL time.Duration
+	// Whether to delete expired preview environments instead of deploying.
+	previewGC bool
 	// Whether to enable debug mode.
 	debug bool
 }
@@ -62,47 +169,78 @@ type deployHelm struct {
 	cliValues        []string
 	helmArchive      string
 	valuesFiles      []string
-	clientset        *kubernetes.Clientset
+	diff             []byte
+	changeClass      changeClass
+	sopsEnv          []string
+	importedKeys     importedKeys
+	// Clientset of the cluster the pipeline runs in, e.g. to read secrets.
+	clientset kubernetes.Interface
+	// Clientset of the cluster the release is deployed to. Equals clientset
+	// unless an external API server is configured.
+	targetClientset kubernetes.Interface
+	// Config to access the cluster the pipeline runs in.
+	restConfig       *rest.Config
 	subrepos         []fs.DirEntry
 	ctxt             *pipelinectxt.ODSContext
+	cleanupFuncs     []func()
+	failureSteps     []DeployStep
+	readinessResults []readinessResult
+	teardown         *teardownReport
+	// Images promoted into the release namespace, collected on teardown.
+	promotedImages []promotedImage
+	// Lock of the release, if held.
+	lock *releaseLock
+	// Masks sensitive values in output.
+	redactor *redact.Redactor
 }
 
 var defaultOptions = options{
-	checkoutDir:          ".",
-	chartDir:             "./chart",
-	ageKeySecretField:    "key.txt",
-	certDir:              defaultCertDir(),
-	srcRegistryTLSVerify: true,
-	debug:                (os.Getenv("DEBUG") == "true"),
+	checkoutDir:              ".",
+	chartDir:                 "./chart",
+	ageKeySecretField:        "key.txt",
+	pgpKeySecretField:        "private.asc",
+	vaultTokenSecretField:    "token",
+	certDir:                  defaultCertDir(),
+	srcRegistryTLSVerify:     true,
+	preflight:                true,
+	releaseLock:              true,
+	releaseLockTimeout:       15 * time.Minute,
+	pendingReleasePolicy:     pendingPolicyNone,
+	pendingReleaseThreshold:  30 * time.Minute,
+	approvalTimeout:          30 * time.Minute,
+	approvalThreshold:        changeClassImageOnly.String(),
+	progressInterval:         10 * time.Second,
+	previewNamespaceTemplate: "{{.Project}}-preview-{{.Key}}",
+	previewReleaseTemplate:   "{{.Component}}",
+	previewTTL:               7 * 24 * time.Hour,
+	imagePullerClusterRole:   "system:image-puller",
+	pipelineServiceAccount:   "pipeline",
+	onDestructiveChange:      destructiveChangeAllow,
+	debug:                    (os.Getenv("DEBUG") == "true"),
 }
 
 type targetEnvironment struct {
-	APIServer         string
-	APIToken          string
+	APIServer string
+	APIToken  string
+	// CA certificate of the API server.
+	CAData []byte
+	// Client certificate and key to authenticate with.
+	CertData []byte
+	KeyData  []byte
+	// Whether to skip TLS verification of the API server.
+	Insecure bool
+	// Kubeconfig file passed to Helm if the credentials cannot be passed as flags.
+	KubeconfigFile    string
 	RegistryHost      string
 	RegistryTLSVerify *bool
 	Namespace         string
 }
 
 func main() {
-	opts := options{}
-	flag.StringVar(&opts.checkoutDir, "checkout-dir", defaultOptions.checkoutDir, "Checkout dir")
-	flag.StringVar(&opts.chartDir, "chart-dir", defaultOptions.chartDir, "Chart dir")
-	flag.StringVar(&opts.releaseName, "release-name", defaultOptions.releaseName, "Name of Helm release")
-	flag.StringVar(&opts.diffFlags, "diff-flags", defaultOptions.diffFlags, "Flags to pass to `helm diff upgrade` (in addition to default ones and upgrade flags)")
-	flag.StringVar(&opts.upgradeFlags, "upgrade-flags", defaultOptions.upgradeFlags, "Flags to pass to `helm upgrade`")
-	flag.StringVar(&opts.ageKeySecret, "age-key-secret", defaultOptions.ageKeySecret, "Name of the secret containing the age key to use for helm-secrets")
-	flag.StringVar(&opts.ageKeySecretField, "age-key-secret-field", defaultOptions.ageKeySecretField, "Name of the field in the secret holding the age private key")
-	flag.StringVar(&opts.apiServer, "api-server", defaultOptions.apiServer, "API server of the target cluster, including scheme")
-	flag.StringVar(&opts.apiCredentialsSecret, "api-credentials-secret", defaultOptions.apiCredentialsSecret, "Name of the Secret resource holding the API user credentials")
-	flag.StringVar(&opts.registryHost, "registry-host", defaultOptions.registryHost, "Hostname of the target registry to push images to")
-	flag.StringVar(&opts.namespace, "namespace", defaultOptions.namespace, "Target K8s namespace (or OpenShift project) to deploy into")
-	flag.StringVar(&opts.certDir, "cert-dir", defaultOptions.certDir, "Use certificates at the specified path to access the registry")
-	flag.BoolVar(&opts.srcRegistryTLSVerify, "src-registry-tls-verify", defaultOptions.srcRegistryTLSVerify, "TLS verify source registry")
-	flag.BoolVar(&opts.diffOnly, "diff-only", defaultOptions.diffOnly, "Whether to perform only a diff")
-	flag.BoolVar(&opts.gatherStatus, "gather-status", defaultOptions.gatherStatus, "Whether to gather the Helm release status")
-	flag.BoolVar(&opts.debug, "debug", defaultOptions.debug, "debug mode")
-	flag.Parse()
+	cmd, opts, err := parseArgs(os.Args[1:], os.Stderr)
+	if err != nil {
+		os.Exit(2)
+	}
 
 	var logger logging.LeveledLoggerInterface
 	if opts.debug {
@@ -111,23 +249,13 @@ func main() {
 		logger = &logging.LeveledLogger{Level: logging.LevelInfo}
 	}
 
-	err := (&deployHelm{helmBin: helmBin, logger: logger, opts: opts}).runSteps(
-		setupContext(),
-		skipOnEmptyNamespace(),
-		setReleaseTarget(),
-		detectSubrepos(),
-		listHelmPlugins(),
-		packageHelmChartWithSubcharts(),
-		collectValuesFiles(),
-		importAgeKey(),
-		diffHelmRelease(),
-		detectImageDigests(),
-		copyImagesIntoReleaseNamespace(),
-		upgradeHelmRelease(),
-		gatherHelmStatus(),
-	)
+	redactor := redact.New()
+	command.SetRedactor(redactor)
+
+	d := &deployHelm{helmBin: helmBin, logger: logger, opts: opts, redactor: redactor}
+	err = d.runSteps(cmd.steps(opts)...)
 	if err != nil {
-		logger.Errorf(err.Error())
+		logger.Errorf(redactor.String(err.Error()))
 		os.Exit(1)
 	}
 }
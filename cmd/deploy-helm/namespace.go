@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// imagePullerRoleBindingName is the name of the RoleBinding allowing the
+// pipeline service account to pull images from the release namespace.
+const imagePullerRoleBindingName = "ods-pipeline-image-puller"
+
+// namespaceSpec describes how the release namespace should look like.
+type namespaceSpec struct {
+	labels      map[string]string
+	annotations map[string]string
+	// Whether the namespace must be a preview namespace if it exists already.
+	preview       bool
+	resourceQuota *corev1.ResourceQuota
+	limitRange    *corev1.LimitRange
+	roleBinding   *rbacv1.RoleBinding
+}
+
+// ensureNamespace creates the release namespace if it does not exist, and
+// applies the configured labels, annotations, ResourceQuota, LimitRange and
+// image puller RoleBinding. It runs if -ensure-namespace is set, or in
+// preview mode.
+func ensureNamespace() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.ensureNamespace && !d.opts.preview {
+			return d, nil
+		}
+		spec, err := d.namespaceSpec(time.Now())
+		if err != nil {
+			return d, err
+		}
+		err = applyNamespace(d.targetClientset, d.releaseNamespace, spec, d.logger.Infof)
+		if err != nil {
+			return d, err
+		}
+		return d, nil
+	}
+}
+
+// namespaceSpec assembles the desired state of the release namespace from
+// the options.
+func (d *deployHelm) namespaceSpec(now time.Time) (*namespaceSpec, error) {
+	spec := &namespaceSpec{preview: d.opts.preview}
+	var err error
+	if d.opts.ensureNamespace {
+		spec.labels, err = parseKeyValues(d.opts.namespaceLabels)
+		if err != nil {
+			return nil, fmt.Errorf("namespace labels: %w", err)
+		}
+		spec.annotations, err = parseKeyValues(d.opts.namespaceAnnotations)
+		if err != nil {
+			return nil, fmt.Errorf("namespace annotations: %w", err)
+		}
+		if d.opts.resourceQuotaFile != "" {
+			spec.resourceQuota = &corev1.ResourceQuota{}
+			err = readObjectFile(d.opts.resourceQuotaFile, spec.resourceQuota)
+			if err != nil {
+				return nil, fmt.Errorf("resource quota: %w", err)
+			}
+		}
+		if d.opts.limitRangeFile != "" {
+			spec.limitRange = &corev1.LimitRange{}
+			err = readObjectFile(d.opts.limitRangeFile, spec.limitRange)
+			if err != nil {
+				return nil, fmt.Errorf("limit range: %w", err)
+			}
+		}
+		if d.opts.imagePullerClusterRole != "" && d.releaseNamespace != d.ctxt.Namespace {
+			spec.roleBinding = imagePullerRoleBinding(d.opts.imagePullerClusterRole, d.ctxt.Namespace, d.opts.pipelineServiceAccount)
+		}
+	}
+	if d.opts.preview {
+		preview := previewNamespace(d.releaseNamespace, newPreviewTemplateData(d.ctxt), d.opts.previewTTL, now)
+		spec.labels = mergeMaps(spec.labels, preview.Labels)
+		spec.annotations = mergeMaps(spec.annotations, preview.Annotations)
+	}
+	return spec, nil
+}
+
+// applyNamespace creates or updates the namespace and its objects as
+// described by spec.
+func applyNamespace(clientset kubernetes.Interface, name string, spec *namespaceSpec, logf func(format string, args ...interface{})) error {
+	ctx := context.TODO()
+	namespaces := clientset.CoreV1().Namespaces()
+	ns, err := namespaces.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		logf("Creating namespace %s ...", name)
+		ns = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      spec.labels,
+			Annotations: spec.annotations,
+		}}
+		_, err = namespaces.Create(ctx, ns, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("create namespace %s: %w", name, err)
+		}
+	case err != nil:
+		return fmt.Errorf("get namespace %s: %w", name, err)
+	default:
+		if spec.preview && ns.Labels[previewLabel] != "true" {
+			return fmt.Errorf("namespace %s exists but is not a preview namespace (label %s missing)", name, previewLabel)
+		}
+		if len(spec.labels) > 0 || len(spec.annotations) > 0 {
+			ns.Labels = mergeMaps(ns.Labels, spec.labels)
+			ns.Annotations = mergeMaps(ns.Annotations, spec.annotations)
+			_, err = namespaces.Update(ctx, ns, metav1.UpdateOptions{})
+			if err != nil {
+				return fmt.Errorf("update namespace %s: %w", name, err)
+			}
+		}
+	}
+
+	if spec.resourceQuota != nil {
+		logf("Applying ResourceQuota %s ...", spec.resourceQuota.Name)
+		err := applyResourceQuota(ctx, clientset, name, spec.resourceQuota)
+		if err != nil {
+			return fmt.Errorf("apply resource quota %s: %w", spec.resourceQuota.Name, err)
+		}
+	}
+	if spec.limitRange != nil {
+		logf("Applying LimitRange %s ...", spec.limitRange.Name)
+		err := applyLimitRange(ctx, clientset, name, spec.limitRange)
+		if err != nil {
+			return fmt.Errorf("apply limit range %s: %w", spec.limitRange.Name, err)
+		}
+	}
+	if spec.roleBinding != nil {
+		logf("Applying RoleBinding %s ...", spec.roleBinding.Name)
+		err := applyRoleBinding(ctx, clientset, name, spec.roleBinding)
+		if err != nil {
+			return fmt.Errorf("apply role binding %s: %w", spec.roleBinding.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyResourceQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, rq *corev1.ResourceQuota) error {
+	client := clientset.CoreV1().ResourceQuotas(namespace)
+	rq.Namespace = namespace
+	existing, err := client.Get(ctx, rq.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, rq, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Spec = rq.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func applyLimitRange(ctx context.Context, clientset kubernetes.Interface, namespace string, lr *corev1.LimitRange) error {
+	client := clientset.CoreV1().LimitRanges(namespace)
+	lr.Namespace = namespace
+	existing, err := client.Get(ctx, lr.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, lr, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Spec = lr.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func applyRoleBinding(ctx context.Context, clientset kubernetes.Interface, namespace string, rb *rbacv1.RoleBinding) error {
+	client := clientset.RbacV1().RoleBindings(namespace)
+	rb.Namespace = namespace
+	existing, err := client.Get(ctx, rb.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, rb, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// The role of a binding cannot be changed.
+	if existing.RoleRef != rb.RoleRef {
+		return fmt.Errorf("existing binding refers to %s %s", existing.RoleRef.Kind, existing.RoleRef.Name)
+	}
+	existing.Subjects = rb.Subjects
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// imagePullerRoleBinding binds clusterRole to the pipeline service account.
+func imagePullerRoleBinding(clusterRole, pipelineNamespace, serviceAccount string) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: imagePullerRoleBindingName},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     clusterRole,
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      serviceAccount,
+			Namespace: pipelineNamespace,
+		}},
+	}
+}
+
+// readObjectFile reads the K8s object in filename into obj. The object
+// must have a name.
+func readObjectFile(filename string, obj metav1.Object) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(content, obj)
+	if err != nil {
+		return fmt.Errorf("unmarshal %s: %w", filename, err)
+	}
+	if obj.GetName() == "" {
+		return fmt.Errorf("%s: metadata.name is required", filename)
+	}
+	return nil
+}
+
+// parseKeyValues parses whitespace separated entries of the form key=value.
+func parseKeyValues(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range strings.Fields(s) {
+		key, value, found := strings.Cut(entry, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("entry %q must be of the form key=value", entry)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApplyNamespace(t *testing.T) {
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute"},
+		Spec: corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{
+			corev1.ResourceLimitsMemory: resource.MustParse("4Gi"),
+		}},
+	}
+	tests := map[string]struct {
+		existing   []runtime.Object
+		spec       *namespaceSpec
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		"namespace is created": {
+			spec: &namespaceSpec{
+				labels:        map[string]string{"team": "foo"},
+				resourceQuota: quota.DeepCopy(),
+				roleBinding:   imagePullerRoleBinding("system:image-puller", "foo-cd", "pipeline"),
+			},
+			wantLabels: map[string]string{"team": "foo"},
+		},
+		"labels are merged into existing namespace": {
+			existing: []runtime.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-dev", Labels: map[string]string{"owner": "bar", "team": "bar"}}},
+				&corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "foo-dev"}},
+			},
+			spec: &namespaceSpec{
+				labels:        map[string]string{"team": "foo"},
+				resourceQuota: quota.DeepCopy(),
+			},
+			wantLabels: map[string]string{"owner": "bar", "team": "foo"},
+		},
+		"existing namespace is not a preview": {
+			existing: []runtime.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-dev"}},
+			},
+			spec:    &namespaceSpec{preview: true, labels: map[string]string{previewLabel: "true"}},
+			wantErr: true,
+		},
+		"existing binding refers to other role": {
+			existing: []runtime.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-dev"}},
+				&rbacv1.RoleBinding{
+					ObjectMeta: metav1.ObjectMeta{Name: imagePullerRoleBindingName, Namespace: "foo-dev"},
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "admin"},
+				},
+			},
+			spec:    &namespaceSpec{roleBinding: imagePullerRoleBinding("system:image-puller", "foo-cd", "pipeline")},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tc.existing...)
+			err := applyNamespace(clientset, "foo-dev", tc.spec, t.Logf)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "foo-dev", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.wantLabels, ns.Labels); diff != "" {
+				t.Fatalf("labels mismatch (-want +got):\n%s", diff)
+			}
+			if tc.spec.resourceQuota != nil {
+				rq, err := clientset.CoreV1().ResourceQuotas("foo-dev").Get(context.TODO(), "compute", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(quota.Spec, rq.Spec); diff != "" {
+					t.Fatalf("quota mismatch (-want +got):\n%s", diff)
+				}
+			}
+			if tc.spec.roleBinding != nil {
+				rb, err := clientset.RbacV1().RoleBindings("foo-dev").Get(context.TODO(), imagePullerRoleBindingName, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "pipeline", Namespace: "foo-cd"}}
+				if diff := cmp.Diff(want, rb.Subjects); diff != "" {
+					t.Fatalf("subjects mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestReadObjectFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "limit-range.yaml")
+	err := os.WriteFile(valid, []byte(`apiVersion: v1
+kind: LimitRange
+metadata:
+  name: defaults
+spec:
+  limits:
+  - type: Container
+    default:
+      memory: 512Mi
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unnamed := filepath.Join(dir, "unnamed.yaml")
+	err = os.WriteFile(unnamed, []byte("kind: LimitRange\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lr := &corev1.LimitRange{}
+	err = readObjectFile(valid, lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lr.Spec.Limits[0].Default.Memory().String(); got != "512Mi" {
+		t.Fatalf("want default memory 512Mi, got %s", got)
+	}
+	err = readObjectFile(unnamed, &corev1.LimitRange{})
+	if err == nil {
+		t.Fatal("want err for object without name, got none")
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	got, err := parseKeyValues("team=foo  cost-center=42\nempty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"team": "foo", "cost-center": "42", "empty": ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	_, err = parseKeyValues("team")
+	if err == nil {
+		t.Fatal("want err for entry without value, got none")
+	}
+}
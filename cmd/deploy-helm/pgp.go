@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+)
+
+const (
+	gpgBin = "gpg"
+	// pgpKeyFilename is the name of the file holding the exported PGP
+	// private key inside the temporary GnuPG home directory.
+	pgpKeyFilename = "private.asc"
+)
+
+// pgpKeyProvider imports an (armored) PGP private key from a K8s secret
+// into a dedicated GnuPG keyring.
+type pgpKeyProvider struct{}
+
+func (p *pgpKeyProvider) name() string {
+	return "PGP"
+}
+
+func (p *pgpKeyProvider) configured(opts options) bool {
+	return len(opts.pgpKeySecret) > 0
+}
+
+func (p *pgpKeyProvider) importKey(d *deployHelm) ([]string, bool, error) {
+	secret, err := d.keySecret(d.opts.pgpKeySecret)
+	if err != nil {
+		return nil, false, fmt.Errorf("get secret %s: %w", d.opts.pgpKeySecret, err)
+	}
+	if secret == nil {
+		d.logger.Infof("No secret %q found in namespace %q, skipping.", d.opts.pgpKeySecret, d.ctxt.Namespace)
+		return nil, false, nil
+	}
+	gnupgHome, err := os.MkdirTemp("", "gnupg")
+	if err != nil {
+		return nil, false, fmt.Errorf("create GnuPG home: %w", err)
+	}
+	d.addCleanup(func() {
+		if err := os.RemoveAll(gnupgHome); err != nil {
+			d.logger.Warnf("Could not remove GnuPG home: %s", err)
+		}
+	})
+	d.redactor.Add(string(secret.Data[d.opts.pgpKeySecretField]))
+	keyFile := filepath.Join(gnupgHome, pgpKeyFilename)
+	err = os.WriteFile(keyFile, secret.Data[d.opts.pgpKeySecretField], 0600)
+	if err != nil {
+		return nil, false, fmt.Errorf("write PGP key: %w", err)
+	}
+	env := []string{fmt.Sprintf("GNUPGHOME=%s", gnupgHome)}
+	err = command.Run(gpgBin, []string{"--batch", "--import", keyFile}, env, os.Stdout, os.Stderr)
+	if err != nil {
+		return nil, false, fmt.Errorf("import PGP key: %w", err)
+	}
+	d.logger.Infof("PGP key secret %s imported.", d.opts.pgpKeySecret)
+	fingerprints, err := pgpFingerprints(env)
+	if err != nil {
+		return nil, false, fmt.Errorf("determine PGP fingerprints: %w", err)
+	}
+	d.importedKeys.pgpFingerprints = append(d.importedKeys.pgpFingerprints, fingerprints...)
+	return env, true, nil
+}
+
+// pgpFingerprints lists the fingerprints of all secret keys (and subkeys)
+// in the keyring configured via env.
+func pgpFingerprints(env []string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	err := command.RunRaw(gpgBin, []string{"--batch", "--list-secret-keys", "--with-colons"}, env, &stdout, &stderr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parsePGPFingerprints(stdout.String()), nil
+}
+
+// parsePGPFingerprints extracts the fingerprints from the colon-delimited
+// output of gpg.
+func parsePGPFingerprints(out string) []string {
+	fingerprints := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 9 && fields[0] == "fpr" && fields[9] != "" {
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+	return fingerprints
+}
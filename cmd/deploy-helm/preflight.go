@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// imageGroupVersion is the API of the OpenShift image registry, which
+// authorizes image pushes through the RBAC of the cluster.
+const imageGroupVersion = "image.openshift.io/v1"
+
+// accessCheck is a set of verbs required on a resource.
+type accessCheck struct {
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+	// Whether the resource is cluster scoped.
+	clusterScoped bool
+	// What the access is needed for.
+	purpose string
+	// Whether the deployment works without the access (with reduced
+	// functionality), in which case missing access is only a warning.
+	optional bool
+}
+
+func (c accessCheck) String() string {
+	name := c.resource
+	if c.group != "" {
+		name += "." + c.group
+	}
+	if c.subresource != "" {
+		name += "/" + c.subresource
+	}
+	return name
+}
+
+// preflightResult is the outcome of a single preflight check.
+type preflightResult struct {
+	check   string
+	ok      bool
+	skipped bool
+	warning bool
+	detail  string
+}
+
+// preflightReport collects the outcome of all preflight checks.
+type preflightReport struct {
+	namespace string
+	results   []preflightResult
+}
+
+func (r *preflightReport) failures() int {
+	n := 0
+	for _, res := range r.results {
+		if !res.ok && !res.skipped && !res.warning {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *preflightReport) warnings() int {
+	n := 0
+	for _, res := range r.results {
+		if res.warning {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *preflightReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Preflight check of namespace %s:\n", r.namespace)
+	for _, res := range r.results {
+		status := "FAIL"
+		if res.skipped {
+			status = "SKIP"
+		} else if res.warning {
+			status = "WARN"
+		} else if res.ok {
+			status = "OK"
+		}
+		fmt.Fprintf(&sb, "  [%s] %s", status, res.check)
+		if res.detail != "" {
+			fmt.Fprintf(&sb, ": %s", res.detail)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// runPreflight checks that the target cluster is reachable and that the
+// credentials allow everything the deployment needs, before any work is done.
+func runPreflight() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.preflight {
+			return d, nil
+		}
+		checkPush := false
+		if !d.opts.diffOnly {
+			var err error
+			checkPush, err = hasImagesToPromote()
+			if err != nil {
+				return d, err
+			}
+		}
+		report := preflight(d.targetClientset, d.releaseNamespace, d.preflightChecks(), checkPush)
+		fmt.Print(report)
+		failures, warnings := report.failures(), report.warnings()
+		if checks := d.pipelinePreflightChecks(checkPush); len(checks) > 0 {
+			pipelineReport := preflight(d.clientset, d.ctxt.Namespace, checks, false)
+			fmt.Print(pipelineReport)
+			failures += pipelineReport.failures()
+			warnings += pipelineReport.warnings()
+		}
+		if failures > 0 {
+			return d, fmt.Errorf("preflight check failed with %d problem(s), see report above", failures)
+		}
+		if warnings > 0 {
+			d.logger.Warnf("Preflight check found %d warning(s), some functionality may not be available.", warnings)
+		}
+		return d, nil
+	}
+}
+
+// pipelinePreflightChecks returns the access required in the namespace the
+// pipeline runs in, where the promoted images are recorded.
+func (d *deployHelm) pipelinePreflightChecks(checkPush bool) []accessCheck {
+	if !checkPush {
+		return nil
+	}
+	return []accessCheck{
+		{resource: "configmaps", verbs: []string{"get", "create", "update"}, purpose: "record of promoted images"},
+	}
+}
+
+// preflightChecks returns the access required by the steps of the
+// deployment. The access to the resources of the chart is not checked as it
+// depends on the chart, and Helm reports missing access clearly.
+func (d *deployHelm) preflightChecks() []accessCheck {
+	if d.opts.diffOnly {
+		return []accessCheck{
+			{resource: "secrets", verbs: []string{"get", "list"}, purpose: "Helm release storage"},
+		}
+	}
+	checks := []accessCheck{
+		{resource: "secrets", verbs: []string{"get", "list", "create", "update"}, purpose: "Helm release storage"},
+		{resource: "secrets", verbs: []string{"delete"}, purpose: "pruning of the release history", optional: true},
+	}
+	if d.opts.releaseLock {
+		checks = append(checks, accessCheck{group: "coordination.k8s.io", resource: "leases", verbs: []string{"get", "create", "update", "delete"}, purpose: "release lock", optional: true})
+	}
+	if d.opts.progressInterval > 0 {
+		watchVerbs := []string{"list", "watch"}
+		checks = append(checks,
+			accessCheck{group: "apps", resource: "deployments", verbs: watchVerbs, purpose: "rollout progress", optional: true},
+			accessCheck{group: "apps", resource: "statefulsets", verbs: watchVerbs, purpose: "rollout progress", optional: true},
+			accessCheck{group: "apps", resource: "daemonsets", verbs: watchVerbs, purpose: "rollout progress", optional: true},
+			accessCheck{group: "batch", resource: "jobs", verbs: watchVerbs, purpose: "rollout progress", optional: true},
+			accessCheck{resource: "pods", verbs: watchVerbs, purpose: "rollout progress", optional: true},
+		)
+	}
+	checks = append(checks,
+		accessCheck{resource: "pods", verbs: []string{"list"}, purpose: "release status and failure diagnostics", optional: true},
+		accessCheck{resource: "pods", subresource: "log", verbs: []string{"get"}, purpose: "failure diagnostics", optional: true},
+		accessCheck{resource: "events", verbs: []string{"list"}, purpose: "release status", optional: true},
+	)
+	namespaceVerbs := []string{"get", "create", "update"}
+	if d.opts.ensureNamespace || d.opts.preview {
+		checks = append(checks, accessCheck{resource: "namespaces", verbs: namespaceVerbs, clusterScoped: true, purpose: "release namespace"})
+	}
+	if d.opts.ensureNamespace {
+		if d.opts.resourceQuotaFile != "" {
+			checks = append(checks, accessCheck{resource: "resourcequotas", verbs: namespaceVerbs, purpose: "namespace quota"})
+		}
+		if d.opts.limitRangeFile != "" {
+			checks = append(checks, accessCheck{resource: "limitranges", verbs: namespaceVerbs, purpose: "namespace limit range"})
+		}
+		if d.opts.imagePullerClusterRole != "" && d.releaseNamespace != d.ctxt.Namespace {
+			checks = append(checks, accessCheck{group: "rbac.authorization.k8s.io", resource: "rolebindings", verbs: namespaceVerbs, purpose: "image puller binding"})
+		}
+	}
+	return checks
+}
+
+// preflight checks connectivity to the cluster, the validity of the token
+// and the access to the resources of checks in namespace. If checkPush is
+// set, it also checks whether images can be pushed into namespace. If
+// namespace does not exist yet (e.g. as it is created by the deployment),
+// only the access to cluster scoped resources is checked.
+func preflight(clientset kubernetes.Interface, namespace string, checks []accessCheck, checkPush bool) *preflightReport {
+	report := &preflightReport{namespace: namespace}
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		report.results = append(report.results, preflightResult{check: "API server", detail: describeAPIError(err)})
+		return report
+	}
+	report.results = append(report.results, preflightResult{check: "API server", ok: true, detail: "reachable, version " + version.GitVersion})
+
+	_, err = clientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	namespaceExists := !apierrors.IsNotFound(err)
+
+	for _, c := range checks {
+		ns := namespace
+		if c.clusterScoped {
+			ns = ""
+		} else if !namespaceExists {
+			report.results = append(report.results, preflightResult{check: c.String(), skipped: true, detail: "namespace does not exist yet"})
+			continue
+		}
+		var missing []string
+		for _, verb := range c.verbs {
+			allowed, err := canI(clientset, ns, verb, c)
+			if err != nil {
+				// Without a valid token, no further check can succeed.
+				report.results = append(report.results, preflightResult{check: "access review", detail: describeAPIError(err)})
+				return report
+			}
+			if !allowed {
+				missing = append(missing, verb)
+			}
+		}
+		if len(missing) > 0 {
+			detail := fmt.Sprintf("missing %s (needed for %s)", strings.Join(missing, ", "), c.purpose)
+			report.results = append(report.results, preflightResult{check: c.String(), warning: c.optional, detail: detail})
+		} else {
+			report.results = append(report.results, preflightResult{check: c.String(), ok: true, detail: strings.Join(c.verbs, ", ")})
+		}
+	}
+
+	if checkPush {
+		if namespaceExists {
+			report.results = append(report.results, checkImagePush(clientset, namespace))
+		} else {
+			report.results = append(report.results, preflightResult{check: "image push", skipped: true, detail: "namespace does not exist yet"})
+		}
+	}
+	return report
+}
+
+// checkImagePush checks whether images can be pushed into namespace. This is
+// only possible for the OpenShift image registry, which pushes are allowed
+// for if the imagestreams/layers subresource can be updated.
+func checkImagePush(clientset kubernetes.Interface, namespace string) preflightResult {
+	_, err := clientset.Discovery().ServerResourcesForGroupVersion(imageGroupVersion)
+	if apierrors.IsNotFound(err) {
+		return preflightResult{check: "image push", skipped: true, detail: "registry permissions are not managed by the cluster"}
+	}
+	if err != nil {
+		return preflightResult{check: "image push", detail: describeAPIError(err)}
+	}
+	layers := accessCheck{group: "image.openshift.io", resource: "imagestreams", subresource: "layers"}
+	allowed, err := canI(clientset, namespace, "update", layers)
+	if err != nil {
+		return preflightResult{check: "image push", detail: describeAPIError(err)}
+	}
+	if !allowed {
+		return preflightResult{check: "image push", detail: "missing update on " + layers.String()}
+	}
+	return preflightResult{check: "image push", ok: true}
+}
+
+// canI asks the API server whether the current user may perform verb on the
+// resource of c in namespace.
+func canI(clientset kubernetes.Interface, namespace, verb string, c accessCheck) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Group:       c.group,
+				Resource:    c.resource,
+				Subresource: c.subresource,
+			},
+		},
+	}
+	res, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return res.Status.Allowed, nil
+}
+
+// describeAPIError explains authentication and authorization errors.
+func describeAPIError(err error) string {
+	switch {
+	case apierrors.IsUnauthorized(err):
+		return "token is invalid or expired (401 Unauthorized)"
+	case apierrors.IsForbidden(err):
+		return "token is valid but not allowed to perform the check (403 Forbidden)"
+	}
+	return fmt.Sprintf("not reachable: %s", err)
+}
+
+// hasImagesToPromote returns whether image artifacts exist in the repository
+// or any of its subrepositories.
+func hasImagesToPromote() (bool, error) {
+	subrepos, err := pipelinectxt.DetectSubrepos()
+	if err != nil {
+		return false, fmt.Errorf("detect subrepos: %w", err)
+	}
+	digests, err := pipelinectxt.ReadArtifactFilesIncludingSubrepos(pipelinectxt.ImageDigestsPath, subrepos)
+	if err != nil {
+		return false, fmt.Errorf("collect image digests: %w", err)
+	}
+	return len(digests) > 0, nil
+}
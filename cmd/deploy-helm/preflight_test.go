@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPreflight(t *testing.T) {
+	checks := []accessCheck{
+		{resource: "secrets", verbs: []string{"get", "create"}, purpose: "Helm release storage"},
+		{group: "apps", resource: "deployments", verbs: []string{"list", "watch"}, purpose: "rollout progress", optional: true},
+		{resource: "namespaces", verbs: []string{"get"}, clusterScoped: true, purpose: "release namespace"},
+	}
+	tests := map[string]struct {
+		// Combinations of verb and resource which are not allowed.
+		denied       map[string]bool
+		versionErr   error
+		reviewErr    error
+		imageAPI     bool
+		checkPush    bool
+		noNamespace  bool
+		want         []preflightResult
+		wantFailures int
+		wantWarnings int
+	}{
+		"all allowed": {
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", ok: true, detail: "get, create"},
+				{check: "deployments.apps", ok: true, detail: "list, watch"},
+				{check: "namespaces", ok: true, detail: "get"},
+			},
+		},
+		"missing verbs": {
+			denied: map[string]bool{"create secrets": true},
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", detail: "missing create (needed for Helm release storage)"},
+				{check: "deployments.apps", ok: true, detail: "list, watch"},
+				{check: "namespaces", ok: true, detail: "get"},
+			},
+			wantFailures: 1,
+		},
+		"missing optional verbs": {
+			denied: map[string]bool{"watch deployments": true},
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", ok: true, detail: "get, create"},
+				{check: "deployments.apps", warning: true, detail: "missing watch (needed for rollout progress)"},
+				{check: "namespaces", ok: true, detail: "get"},
+			},
+			wantWarnings: 1,
+		},
+		"namespace does not exist yet": {
+			noNamespace: true,
+			checkPush:   true,
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", skipped: true, detail: "namespace does not exist yet"},
+				{check: "deployments.apps", skipped: true, detail: "namespace does not exist yet"},
+				{check: "namespaces", ok: true, detail: "get"},
+				{check: "image push", skipped: true, detail: "namespace does not exist yet"},
+			},
+		},
+		"unreachable": {
+			versionErr: apierrors.NewUnauthorized("invalid token"),
+			want: []preflightResult{
+				{check: "API server", detail: "token is invalid or expired (401 Unauthorized)"},
+			},
+			wantFailures: 1,
+		},
+		"access review forbidden": {
+			reviewErr: apierrors.NewForbidden(schema.GroupResource{Resource: "selfsubjectaccessreviews"}, "", nil),
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "access review", detail: "token is valid but not allowed to perform the check (403 Forbidden)"},
+			},
+			wantFailures: 1,
+		},
+		"image push without image API": {
+			checkPush: true,
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", ok: true, detail: "get, create"},
+				{check: "deployments.apps", ok: true, detail: "list, watch"},
+				{check: "namespaces", ok: true, detail: "get"},
+				{check: "image push", skipped: true, detail: "registry permissions are not managed by the cluster"},
+			},
+		},
+		"image push denied": {
+			checkPush: true,
+			imageAPI:  true,
+			denied:    map[string]bool{"update imagestreams": true},
+			want: []preflightResult{
+				{check: "API server", ok: true, detail: "reachable, version v1.27.1"},
+				{check: "secrets", ok: true, detail: "get, create"},
+				{check: "deployments.apps", ok: true, detail: "list, watch"},
+				{check: "namespaces", ok: true, detail: "get"},
+				{check: "image push", detail: "missing update on imagestreams.image.openshift.io/layers"},
+			},
+			wantFailures: 1,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if !tc.noNamespace {
+				clientset = fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-dev"}})
+			}
+			discovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+			discovery.FakedServerVersion = &version.Info{GitVersion: "v1.27.1"}
+			if tc.imageAPI {
+				discovery.Resources = []*metav1.APIResourceList{{GroupVersion: imageGroupVersion}}
+			}
+			clientset.PrependReactor("get", "version", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return tc.versionErr != nil, nil, tc.versionErr
+			})
+			clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if tc.reviewErr != nil {
+					return true, nil, tc.reviewErr
+				}
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				attrs := review.Spec.ResourceAttributes
+				wantNamespace := "foo-dev"
+				if attrs.Resource == "namespaces" {
+					wantNamespace = ""
+				}
+				if attrs.Namespace != wantNamespace {
+					t.Errorf("want review in namespace %q, got %q", wantNamespace, attrs.Namespace)
+				}
+				review.Status.Allowed = !tc.denied[attrs.Verb+" "+attrs.Resource]
+				return true, review, nil
+			})
+			report := preflight(clientset, "foo-dev", checks, tc.checkPush)
+			if diff := cmp.Diff(tc.want, report.results, cmp.AllowUnexported(preflightResult{})); diff != "" {
+				t.Fatalf("results mismatch (-want +got):\n%s", diff)
+			}
+			if got := report.failures(); got != tc.wantFailures {
+				t.Fatalf("want %d failures, got %d", tc.wantFailures, got)
+			}
+			if got := report.warnings(); got != tc.wantWarnings {
+				t.Fatalf("want %d warnings, got %d", tc.wantWarnings, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// previewLabel marks namespaces of preview environments.
+	previewLabel = "opendevstack.org/preview"
+	// previewProjectLabel is the ODS project of a preview environment.
+	previewProjectLabel = "opendevstack.org/project"
+	// previewComponentLabel is the ODS component of a preview environment.
+	previewComponentLabel = "opendevstack.org/component"
+	// previewKeyLabel is the key (pull request or Git ref) of a preview environment.
+	previewKeyLabel = "opendevstack.org/preview-key"
+	// previewTTLAnnotation is how long a preview environment is kept after
+	// its last deployment.
+	previewTTLAnnotation = "opendevstack.org/preview-ttl"
+	// previewDeployedAtAnnotation is the time of the last deployment into a
+	// preview environment.
+	previewDeployedAtAnnotation = "opendevstack.org/preview-deployed-at"
+)
+
+// invalidNameChars matches characters which are not allowed in K8s names.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// previewTemplateData is passed to the templates of the preview namespace
+// and release name.
+type previewTemplateData struct {
+	pipelinectxt.ODSContext
+	// Key identifies the preview: the pull request key if the pipeline runs
+	// for a pull request, the Git ref otherwise.
+	Key string
+}
+
+func newPreviewTemplateData(ctxt *pipelinectxt.ODSContext) previewTemplateData {
+	key := ctxt.PullRequestKey
+	if key == "" {
+		key = ctxt.GitRef
+	}
+	return previewTemplateData{ODSContext: *ctxt, Key: sanitizeName(key, 63)}
+}
+
+// renderPreviewName renders the template text with data and sanitizes the
+// result for use as K8s name of at most maxLen characters.
+func renderPreviewName(text string, data previewTemplateData, maxLen int) (string, error) {
+	tmpl, err := template.New("preview").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse template %q: %w", text, err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("render template %q: %w", text, err)
+	}
+	name := sanitizeName(buf.String(), maxLen)
+	if name == "" {
+		return "", fmt.Errorf("template %q renders to an empty name", text)
+	}
+	return name, nil
+}
+
+// sanitizeName lowercases s, replaces characters not allowed in K8s names
+// with dashes and shortens it to at most maxLen characters.
+func sanitizeName(s string, maxLen int) string {
+	name := invalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(name) > maxLen {
+		name = name[:maxLen]
+	}
+	return strings.Trim(name, "-")
+}
+
+// setPreviewTarget computes the namespace and release name of the preview
+// environment from the configured templates.
+func setPreviewTarget() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.preview {
+			return d, nil
+		}
+		data := newPreviewTemplateData(d.ctxt)
+		if data.Key == "" {
+			return d, errors.New("preview requires a pull request key or Git ref")
+		}
+		namespace, err := renderPreviewName(d.opts.previewNamespaceTemplate, data, 63)
+		if err != nil {
+			return d, fmt.Errorf("preview namespace: %w", err)
+		}
+		// Helm limits release names to 53 characters.
+		releaseName, err := renderPreviewName(d.opts.previewReleaseTemplate, data, 53)
+		if err != nil {
+			return d, fmt.Errorf("preview release name: %w", err)
+		}
+		d.logger.Infof("Deploying preview %s into namespace %s as release %s.", data.Key, namespace, releaseName)
+		d.opts.namespace = namespace
+		d.opts.releaseName = releaseName
+		return d, nil
+	}
+}
+
+// previewNamespace returns the namespace of a preview environment deployed at now.
+func previewNamespace(name string, data previewTemplateData, ttl time.Duration, now time.Time) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				previewLabel:          "true",
+				previewProjectLabel:   sanitizeName(data.Project, 63),
+				previewComponentLabel: sanitizeName(data.Component, 63),
+				previewKeyLabel:       data.Key,
+			},
+			Annotations: map[string]string{
+				previewTTLAnnotation:        ttl.String(),
+				previewDeployedAtAnnotation: now.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+// collectExpiredPreviews deletes the preview namespaces of the project whose
+// TTL has passed since their last deployment, together with the records of
+// the images promoted into them.
+func collectExpiredPreviews() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		err := d.setTargetEnvironment()
+		if err != nil {
+			return d, err
+		}
+		expired, err := expiredPreviews(d.targetClientset, sanitizeName(d.ctxt.Project, 63), time.Now())
+		if err != nil {
+			return d, err
+		}
+		if len(expired) == 0 {
+			d.logger.Infof("No expired previews found.")
+			return d, nil
+		}
+		deleteOptions := metav1.DeleteOptions{}
+		if d.opts.dryRun {
+			deleteOptions.DryRun = []string{metav1.DryRunAll}
+		}
+		for _, ns := range expired {
+			if ns == d.ctxt.Namespace {
+				d.logger.Warnf("Not deleting namespace %s as the pipeline runs in it.", ns)
+				continue
+			}
+			d.logger.Infof("Deleting expired preview namespace %s ...", ns)
+			err := d.targetClientset.CoreV1().Namespaces().Delete(context.TODO(), ns, deleteOptions)
+			if err != nil && !apierrors.IsNotFound(err) {
+				return d, fmt.Errorf("delete preview namespace %s: %w", ns, err)
+			}
+			err = d.deleteNamespacePromotedImagesRecords(ns, deleteOptions)
+			if err != nil {
+				return d, err
+			}
+		}
+		return d, nil
+	}
+}
+
+// expiredPreviews returns the names of the preview namespaces of project
+// whose TTL has passed at now. The TTL counts from the last deployment, or
+// from the creation of the namespace if the deployment time is unknown.
+// Namespaces without a valid TTL never expire.
+func expiredPreviews(clientset kubernetes.Interface, project string, now time.Time) ([]string, error) {
+	selector := labels.SelectorFromSet(labels.Set{previewLabel: "true", previewProjectLabel: project})
+	list, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("list preview namespaces: %w", err)
+	}
+	expired := []string{}
+	for _, ns := range list.Items {
+		ttl, err := time.ParseDuration(ns.Annotations[previewTTLAnnotation])
+		if err != nil || ttl <= 0 {
+			continue
+		}
+		deployedAt := ns.CreationTimestamp.Time
+		if t, err := time.Parse(time.RFC3339, ns.Annotations[previewDeployedAtAnnotation]); err == nil {
+			deployedAt = t
+		}
+		if now.Sub(deployedAt) > ttl {
+			expired = append(expired, ns.Name)
+		}
+	}
+	return expired, nil
+}
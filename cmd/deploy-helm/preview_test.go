@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRenderPreviewName(t *testing.T) {
+	tests := map[string]struct {
+		ctxt     pipelinectxt.ODSContext
+		template string
+		maxLen   int
+		want     string
+		wantErr  bool
+	}{
+		"pull request": {
+			ctxt:     pipelinectxt.ODSContext{Project: "foo", PullRequestKey: "42", GitRef: "feature/bar"},
+			template: "{{.Project}}-preview-{{.Key}}",
+			maxLen:   63,
+			want:     "foo-preview-42",
+		},
+		"git ref is sanitized": {
+			ctxt:     pipelinectxt.ODSContext{Project: "foo", GitRef: "feature/JIRA-123_Bar"},
+			template: "{{.Project}}-preview-{{.Key}}",
+			maxLen:   63,
+			want:     "foo-preview-feature-jira-123-bar",
+		},
+		"name is shortened": {
+			ctxt:     pipelinectxt.ODSContext{Component: "backend", GitRef: "a-very-long-branch-name"},
+			template: "{{.Component}}-{{.Key}}",
+			maxLen:   15,
+			want:     "backend-a-very",
+		},
+		"unknown field": {
+			ctxt:     pipelinectxt.ODSContext{Project: "foo"},
+			template: "{{.Unknown}}",
+			maxLen:   63,
+			wantErr:  true,
+		},
+		"empty name": {
+			ctxt:     pipelinectxt.ODSContext{},
+			template: "{{.Project}}",
+			maxLen:   63,
+			wantErr:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := renderPreviewName(tc.template, newPreviewTemplateData(&tc.ctxt), tc.maxLen)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("name mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExpiredPreviews(t *testing.T) {
+	now := time.Date(2023, 6, 10, 12, 0, 0, 0, time.UTC)
+	data := previewTemplateData{ODSContext: pipelinectxt.ODSContext{Project: "foo", Component: "app"}, Key: "1"}
+	deployedRecently := previewNamespace("foo-preview-1", data, 24*time.Hour, now.Add(-time.Hour))
+	deployedLongAgo := previewNamespace("foo-preview-2", data, 24*time.Hour, now.Add(-48*time.Hour))
+	// Recently created, but deployed long ago.
+	deployedLongAgo.CreationTimestamp = metav1.NewTime(now)
+	withoutTTL := previewNamespace("foo-preview-3", data, 0, now.Add(-48*time.Hour))
+	withoutDeployment := previewNamespace("foo-preview-4", data, 24*time.Hour, now)
+	delete(withoutDeployment.Annotations, previewDeployedAtAnnotation)
+	withoutDeployment.CreationTimestamp = metav1.NewTime(now.Add(-48 * time.Hour))
+	otherProject := previewNamespace("bar-preview-1", previewTemplateData{ODSContext: pipelinectxt.ODSContext{Project: "bar"}, Key: "1"}, 24*time.Hour, now.Add(-48*time.Hour))
+	regular := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "foo-dev",
+		Labels: map[string]string{previewProjectLabel: "foo"},
+	}}
+
+	clientset := fake.NewSimpleClientset(deployedRecently, deployedLongAgo, withoutTTL, withoutDeployment, otherProject, regular)
+	got, err := expiredPreviews(clientset, "foo", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"foo-preview-2", "foo-preview-4"}, got); diff != "" {
+		t.Fatalf("expired previews mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectExpiredPreviews(t *testing.T) {
+	now := time.Now()
+	data := previewTemplateData{ODSContext: pipelinectxt.ODSContext{Project: "foo", Component: "app"}, Key: "1"}
+	promotedImagesRecord := func(releaseNamespace string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:      releaseConfigMapName(promotedImagesConfigMapPrefix, "app", releaseNamespace),
+			Namespace: "foo-cd",
+			Labels:    map[string]string{promotedImagesNamespaceLabel: releaseNamespace},
+		}}
+	}
+	clientset := fake.NewSimpleClientset(
+		previewNamespace("foo-preview-1", data, 24*time.Hour, now.Add(-time.Hour)),
+		previewNamespace("foo-preview-2", data, 24*time.Hour, now.Add(-48*time.Hour)),
+		promotedImagesRecord("foo-preview-1"),
+		promotedImagesRecord("foo-preview-2"),
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "foo-cd"}},
+	)
+	d := &deployHelm{
+		logger:    testLogger(),
+		clientset: clientset,
+		ctxt:      &pipelinectxt.ODSContext{Project: "foo", Namespace: "foo-cd"},
+		redactor:  redact.New(),
+	}
+	_, err := collectExpiredPreviews()(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(get func() error) bool {
+		err := get()
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	got := map[string]bool{}
+	for _, ns := range []string{"foo-preview-1", "foo-preview-2"} {
+		ns := ns
+		got["namespace "+ns] = exists(func() error {
+			_, err := clientset.CoreV1().Namespaces().Get(context.TODO(), ns, metav1.GetOptions{})
+			return err
+		})
+	}
+	for _, name := range []string{promotedImagesRecord("foo-preview-1").Name, promotedImagesRecord("foo-preview-2").Name, "other"} {
+		name := name
+		got["configmap "+name] = exists(func() error {
+			_, err := clientset.CoreV1().ConfigMaps("foo-cd").Get(context.TODO(), name, metav1.GetOptions{})
+			return err
+		})
+	}
+	want := map[string]bool{
+		"namespace foo-preview-1":                                 true,
+		"namespace foo-preview-2":                                 false,
+		"configmap " + promotedImagesRecord("foo-preview-1").Name: true,
+		"configmap " + promotedImagesRecord("foo-preview-2").Name: false,
+		"configmap other":                                         true,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("remaining objects mismatch (-want +got):\n%s", diff)
+	}
+}
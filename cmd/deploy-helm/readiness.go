@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// readinessChecksFilename is the name of the file within the chart
+	// directory configuring readiness checks.
+	readinessChecksFilename = "readiness-checks.yaml"
+	// defaultReadinessCheckTimeout is the timeout of checks which do not specify one.
+	defaultReadinessCheckTimeout = time.Minute
+	// defaultReadinessCheckInterval is the interval in which checks are evaluated.
+	defaultReadinessCheckInterval = 5 * time.Second
+)
+
+// readinessChecksConfig is the content of the readiness checks file.
+type readinessChecksConfig struct {
+	// Interval in which checks are evaluated, e.g. "5s".
+	Interval string           `json:"interval"`
+	Checks   []readinessCheck `json:"checks"`
+}
+
+// readinessCheck describes one readiness check. Either Resource (together
+// with Condition or JSONPath) or HTTP must be set.
+type readinessCheck struct {
+	Name string `json:"name"`
+	// How long to wait for the check to pass, e.g. "2m".
+	Timeout   string                   `json:"timeout"`
+	Resource  *readinessCheckResource  `json:"resource"`
+	Condition *readinessCheckCondition `json:"condition"`
+	// JSONPath expression evaluated against the resource.
+	JSONPath string `json:"jsonPath"`
+	// Expected result of the JSONPath expression. If empty, any non-empty
+	// result passes the check.
+	Value string              `json:"value"`
+	HTTP  *readinessCheckHTTP `json:"http"`
+}
+
+// readinessCheckResource identifies the resource a check evaluates.
+type readinessCheckResource struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	// Defaults to the release namespace.
+	Namespace string `json:"namespace"`
+}
+
+// readinessCheckCondition is a condition in status.conditions the resource
+// needs to have.
+type readinessCheckCondition struct {
+	Type string `json:"type"`
+	// Defaults to "True".
+	Status string `json:"status"`
+}
+
+// readinessCheckHTTP is an HTTP probe.
+type readinessCheckHTTP struct {
+	URL string `json:"url"`
+	// Expected status code. If not set, any 2xx status code passes the check.
+	ExpectedStatus        int  `json:"expectedStatus"`
+	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify"`
+}
+
+// readinessResult is the outcome of a readiness check.
+type readinessResult struct {
+	Name     string `json:"name"`
+	Ready    bool   `json:"ready"`
+	Message  string `json:"message"`
+	Duration string `json:"duration"`
+}
+
+// readinessChecker evaluates readiness checks.
+type readinessChecker struct {
+	dynamicClient dynamic.Interface
+	mapper        meta.RESTMapper
+	namespace     string
+}
+
+// readReadinessChecksConfig reads and validates the readiness checks file.
+// If the file does not exist, nil is returned.
+func readReadinessChecksConfig(filename string) (*readinessChecksConfig, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var config readinessChecksConfig
+	err = yaml.UnmarshalStrict(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	if _, err := parseDurationOrDefault(config.Interval, defaultReadinessCheckInterval); err != nil {
+		return nil, fmt.Errorf("interval: %w", err)
+	}
+	for i, c := range config.Checks {
+		err := c.validate()
+		if err != nil {
+			return nil, fmt.Errorf("check %d (%s): %w", i+1, c.Name, err)
+		}
+	}
+	return &config, nil
+}
+
+func (c readinessCheck) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := parseDurationOrDefault(c.Timeout, defaultReadinessCheckTimeout); err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	switch {
+	case c.Resource != nil && c.HTTP != nil:
+		return errors.New("only one of resource and http can be set")
+	case c.Resource != nil:
+		if c.Resource.APIVersion == "" || c.Resource.Kind == "" || c.Resource.Name == "" {
+			return errors.New("resource requires apiVersion, kind and name")
+		}
+		if (c.Condition == nil) == (c.JSONPath == "") {
+			return errors.New("resource checks require exactly one of condition and jsonPath")
+		}
+		if c.Condition != nil && c.Condition.Type == "" {
+			return errors.New("condition requires type")
+		}
+	case c.HTTP != nil:
+		if c.HTTP.URL == "" {
+			return errors.New("http requires url")
+		}
+	default:
+		return errors.New("one of resource and http is required")
+	}
+	return nil
+}
+
+// parseDurationOrDefault parses s, returning def if s is empty.
+func parseDurationOrDefault(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// run evaluates check every interval until it passes or its timeout is exceeded.
+func (rc *readinessChecker) run(ctx context.Context, check readinessCheck, interval time.Duration) readinessResult {
+	timeout, err := parseDurationOrDefault(check.Timeout, defaultReadinessCheckTimeout)
+	if err != nil {
+		return readinessResult{Name: check.Name, Message: fmt.Sprintf("parse timeout: %s", err)}
+	}
+	start := time.Now()
+	var message string
+	err = wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		ready, msg, err := rc.evaluate(ctx, check)
+		if err != nil {
+			return false, err
+		}
+		message = msg
+		return ready, nil
+	})
+	result := readinessResult{Name: check.Name, Message: message, Duration: time.Since(start).Round(time.Second).String()}
+	switch {
+	case err == nil:
+		result.Ready = true
+	case wait.Interrupted(err):
+		result.Message = fmt.Sprintf("not ready within %s: %s", timeout, message)
+	default:
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// evaluate evaluates check once. An error is returned if the check cannot
+// be evaluated at all (e.g. an unknown resource kind).
+func (rc *readinessChecker) evaluate(ctx context.Context, check readinessCheck) (bool, string, error) {
+	if check.HTTP != nil {
+		ready, msg := probeHTTP(ctx, check.HTTP)
+		return ready, msg, nil
+	}
+	obj, err := rc.getResource(ctx, check.Resource)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, "resource not found", nil
+		}
+		return false, "", err
+	}
+	if check.Condition != nil {
+		ready, msg := evaluateCondition(obj, check.Condition)
+		return ready, msg, nil
+	}
+	return evaluateJSONPath(obj, check.JSONPath, check.Value)
+}
+
+func (rc *readinessChecker) getResource(ctx context.Context, r *readinessCheckResource) (*unstructured.Unstructured, error) {
+	gv, err := schema.ParseGroupVersion(r.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := rc.mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: r.Kind}, gv.Version)
+	if err != nil {
+		return nil, fmt.Errorf("map %s %s: %w", r.APIVersion, r.Kind, err)
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return rc.dynamicClient.Resource(mapping.Resource).Get(ctx, r.Name, metav1.GetOptions{})
+	}
+	ns := r.Namespace
+	if ns == "" {
+		ns = rc.namespace
+	}
+	return rc.dynamicClient.Resource(mapping.Resource).Namespace(ns).Get(ctx, r.Name, metav1.GetOptions{})
+}
+
+// evaluateCondition checks whether obj has the condition in status.conditions.
+func evaluateCondition(obj *unstructured.Unstructured, c *readinessCheckCondition) (bool, string) {
+	want := c.Status
+	if want == "" {
+		want = "True"
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok || condition["type"] != c.Type {
+			continue
+		}
+		status := fmt.Sprint(condition["status"])
+		msg := fmt.Sprintf("condition %s is %s", c.Type, status)
+		if m, ok := condition["message"].(string); ok && m != "" {
+			msg += fmt.Sprintf(" (%s)", m)
+		}
+		return status == want, msg
+	}
+	return false, fmt.Sprintf("condition %s not present", c.Type)
+}
+
+// evaluateJSONPath evaluates expr against obj and compares the result with
+// value. If value is empty, any non-empty result passes.
+func evaluateJSONPath(obj *unstructured.Unstructured, expr, value string) (bool, string, error) {
+	if !strings.HasPrefix(expr, "{") {
+		expr = "{" + expr + "}"
+	}
+	jp := jsonpath.New("readiness").AllowMissingKeys(true)
+	err := jp.Parse(expr)
+	if err != nil {
+		return false, "", fmt.Errorf("parse JSONPath %s: %w", expr, err)
+	}
+	var buf bytes.Buffer
+	err = jp.Execute(&buf, obj.Object)
+	if err != nil {
+		return false, fmt.Sprintf("JSONPath %s: %s", expr, err), nil
+	}
+	got := strings.TrimSpace(buf.String())
+	msg := fmt.Sprintf("JSONPath %s is %q", expr, got)
+	if value == "" {
+		return got != "", msg, nil
+	}
+	return got == value, msg, nil
+}
+
+// probeHTTP sends a GET request to the configured URL.
+func probeHTTP(ctx context.Context, h *readinessCheckHTTP) (bool, string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if h.InsecureSkipTLSVerify {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer res.Body.Close()
+	msg := fmt.Sprintf("GET %s returned %d", h.URL, res.StatusCode)
+	if h.ExpectedStatus != 0 {
+		return res.StatusCode == h.ExpectedStatus, msg
+	}
+	return res.StatusCode >= 200 && res.StatusCode < 300, msg
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestReadReadinessChecksConfig(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		wantErr string
+	}{
+		"valid": {
+			content: `
+interval: 2s
+checks:
+  - name: topic
+    timeout: 2m
+    resource: {apiVersion: kafka.strimzi.io/v1beta2, kind: KafkaTopic, name: orders}
+    condition: {type: Ready}
+  - name: route
+    resource: {apiVersion: route.openshift.io/v1, kind: Route, name: foo}
+    jsonPath: '.status.ingress[0].conditions[0].status'
+    value: 'True'
+  - name: health
+    http: {url: 'https://foo.example.com/health'}
+`,
+		},
+		"missing name": {
+			content: "checks:\n  - http: {url: 'https://foo'}\n",
+			wantErr: "name is required",
+		},
+		"condition and jsonPath": {
+			content: "checks:\n  - name: x\n    resource: {apiVersion: v1, kind: Pod, name: x}\n    condition: {type: Ready}\n    jsonPath: .status\n",
+			wantErr: "exactly one of condition and jsonPath",
+		},
+		"invalid timeout": {
+			content: "checks:\n  - name: x\n    timeout: soon\n    http: {url: 'https://foo'}\n",
+			wantErr: "timeout",
+		},
+		"unknown field": {
+			content: "checks:\n  - name: x\n    htp: {url: 'https://foo'}\n",
+			wantErr: "unknown field",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), readinessChecksFilename)
+			err := os.WriteFile(filename, []byte(tc.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = readReadinessChecksConfig(filename)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("want error containing %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+	config, err := readReadinessChecksConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil || config != nil {
+		t.Fatalf("want no config and no error for missing file, got: %v, %v", config, err)
+	}
+}
+
+func TestReadinessChecker(t *testing.T) {
+	topic := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kafka.strimzi.io/v1beta2",
+		"kind":       "KafkaTopic",
+		"metadata":   map[string]interface{}{"name": "orders", "namespace": "foo-dev"},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "False", "message": "topic is being created"},
+			},
+			"topicName": "orders",
+		},
+	}}
+	topics := schema.GroupVersionResource{Group: "kafka.strimzi.io", Version: "v1beta2", Resource: "kafkatopics"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(), map[schema.GroupVersionResource]string{topics: "KafkaTopicList"}, topic,
+	)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "kafka.strimzi.io", Version: "v1beta2", Kind: "KafkaTopic"}, meta.RESTScopeNamespace)
+	checker := &readinessChecker{dynamicClient: client, mapper: mapper, namespace: "foo-dev"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resource := &readinessCheckResource{APIVersion: "kafka.strimzi.io/v1beta2", Kind: "KafkaTopic", Name: "orders"}
+	tests := map[string]struct {
+		check       readinessCheck
+		wantReady   bool
+		wantMessage string
+	}{
+		"condition not met": {
+			check:       readinessCheck{Name: "topic", Resource: resource, Condition: &readinessCheckCondition{Type: "Ready"}},
+			wantReady:   false,
+			wantMessage: "condition Ready is False (topic is being created)",
+		},
+		"expected condition status": {
+			check:     readinessCheck{Name: "topic", Resource: resource, Condition: &readinessCheckCondition{Type: "Ready", Status: "False"}},
+			wantReady: true,
+		},
+		"JSONPath value": {
+			check:     readinessCheck{Name: "topic", Resource: resource, JSONPath: ".status.topicName", Value: "orders"},
+			wantReady: true,
+		},
+		"JSONPath missing": {
+			check:       readinessCheck{Name: "topic", Resource: resource, JSONPath: "{.status.partitions}"},
+			wantReady:   false,
+			wantMessage: `JSONPath {.status.partitions} is ""`,
+		},
+		"resource not found": {
+			check: readinessCheck{
+				Name:      "topic",
+				Resource:  &readinessCheckResource{APIVersion: "kafka.strimzi.io/v1beta2", Kind: "KafkaTopic", Name: "other"},
+				Condition: &readinessCheckCondition{Type: "Ready"},
+			},
+			wantReady:   false,
+			wantMessage: "resource not found",
+		},
+		"HTTP ok": {
+			check:     readinessCheck{Name: "health", HTTP: &readinessCheckHTTP{URL: server.URL + "/health"}},
+			wantReady: true,
+		},
+		"HTTP unavailable": {
+			check:       readinessCheck{Name: "health", HTTP: &readinessCheckHTTP{URL: server.URL + "/other"}},
+			wantReady:   false,
+			wantMessage: "returned 503",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ready, msg, err := checker.evaluate(context.Background(), tc.check)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ready != tc.wantReady {
+				t.Fatalf("want ready %v, got %v (%s)", tc.wantReady, ready, msg)
+			}
+			if !strings.Contains(msg, tc.wantMessage) {
+				t.Fatalf("want message containing %q, got: %s", tc.wantMessage, msg)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		check := readinessCheck{Name: "topic", Timeout: "50ms", Resource: resource, Condition: &readinessCheckCondition{Type: "Ready"}}
+		result := checker.run(context.Background(), check, 10*time.Millisecond)
+		if result.Ready || !strings.HasPrefix(result.Message, "not ready within 50ms") {
+			t.Fatalf("want timeout, got: %+v", result)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Policies for releases stuck in a pending state.
+	pendingPolicyNone       = "none"
+	pendingPolicyRollback   = "rollback"
+	pendingPolicyMarkFailed = "mark-failed"
+	// helmStatusFailed is the status of a failed Helm revision.
+	helmStatusFailed = "failed"
+	// helmStatusPendingInstall is the status of a release being installed.
+	helmStatusPendingInstall = "pending-install"
+)
+
+// recoverPendingRelease detects a release stuck in a pending state, e.g.
+// because a previous pipeline run was killed during the upgrade. If the
+// pending state is older than the configured threshold and no other pipeline
+// run holds the release lock, the release is rolled back or marked as failed
+// according to the configured policy.
+func recoverPendingRelease() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if d.opts.diffOnly {
+			return d, nil
+		}
+		switch d.opts.pendingReleasePolicy {
+		case pendingPolicyNone, pendingPolicyRollback, pendingPolicyMarkFailed:
+		default:
+			return d, fmt.Errorf(
+				"unknown policy %q for pending releases, must be one of: %s, %s, %s",
+				d.opts.pendingReleasePolicy, pendingPolicyNone, pendingPolicyRollback, pendingPolicyMarkFailed,
+			)
+		}
+		history, err := d.releaseHistory(2)
+		if isReleaseNotFound(err) {
+			return d, nil
+		}
+		if err != nil {
+			return d, fmt.Errorf("read release history: %w", err)
+		}
+		if len(history) == 0 {
+			return d, nil
+		}
+		current := history[len(history)-1]
+		if !strings.HasPrefix(current.Status, "pending-") {
+			return d, nil
+		}
+		since := current.Updated.UTC().Format(time.RFC3339)
+		age := time.Since(current.Updated).Round(time.Second)
+		if age < d.opts.pendingReleaseThreshold {
+			d.logger.Warnf(
+				"Revision %d of release %s is in state %s since %s (%s ago), which is below the threshold of %s. Assuming the operation is still in progress.",
+				current.Revision, d.releaseName, current.Status, since, age, d.opts.pendingReleaseThreshold,
+			)
+			return d, nil
+		}
+		if d.lock == nil {
+			// Without holding the lock ourselves, check that nobody else holds it.
+			lease, err := d.targetClientset.CoordinationV1().Leases(d.releaseNamespace).Get(context.TODO(), releaseLockName(d.releaseName), metav1.GetOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				d.logger.Warnf(
+					"Revision %d of release %s is in state %s since %s, but the release lock cannot be checked: %s. Not recovering.",
+					current.Revision, d.releaseName, current.Status, since, err,
+				)
+				return d, nil
+			}
+			if err == nil && !leaseExpired(lease, time.Now()) {
+				d.logger.Warnf(
+					"Revision %d of release %s is in state %s since %s, but the release is locked by %s. Not recovering.",
+					current.Revision, d.releaseName, current.Status, since, *lease.Spec.HolderIdentity,
+				)
+				return d, nil
+			}
+		}
+
+		policy := d.opts.pendingReleasePolicy
+		if policy == pendingPolicyNone {
+			d.logger.Warnf(
+				"Revision %d of release %s is stuck in state %s since %s. Set the pending release policy to %s or %s to recover automatically.",
+				current.Revision, d.releaseName, current.Status, since, pendingPolicyRollback, pendingPolicyMarkFailed,
+			)
+			return d, nil
+		}
+		if policy == pendingPolicyRollback && (current.Status == helmStatusPendingInstall || len(history) < 2) {
+			d.logger.Warnf("Revision %d of release %s has no previous revision to roll back to, marking it as failed instead.", current.Revision, d.releaseName)
+			policy = pendingPolicyMarkFailed
+		}
+		if policy == pendingPolicyRollback {
+			previous := history[len(history)-2]
+			d.logger.Infof(
+				"Revision %d of release %s is stuck in state %s since %s. Rolling back to revision %d ...",
+				current.Revision, d.releaseName, current.Status, since, previous.Revision,
+			)
+			err := d.helmRollback(previous.Revision, "", os.Stdout, os.Stderr)
+			if err != nil {
+				return d, fmt.Errorf("roll back pending release: %w", err)
+			}
+			d.logger.Infof("Rolled back release %s from revision %d to revision %d.", d.releaseName, current.Revision, previous.Revision)
+			return d, nil
+		}
+		description := fmt.Sprintf("Marked as failed by ods-pipeline-helm after being %s since %s", current.Status, since)
+		err = markReleaseFailed(d.targetClientset, d.releaseNamespace, d.releaseName, current.Revision, description)
+		if err != nil {
+			return d, fmt.Errorf("mark pending release as failed: %w", err)
+		}
+		d.logger.Infof(
+			"Marked revision %d of release %s as failed (was %s since %s).",
+			current.Revision, d.releaseName, current.Status, since,
+		)
+		return d, nil
+	}
+}
+
+// helmReleaseSecretName returns the name of the secret in which Helm stores
+// given revision of the release.
+func helmReleaseSecretName(releaseName string, revision int) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", releaseName, revision)
+}
+
+// markReleaseFailed sets the status of given revision of the release to
+// failed, both in the release stored by Helm and in the labels of its secret.
+// This relies on the storage format of the secrets driver of Helm 3. The
+// secret is only modified if it matches that format, all other fields of the
+// release are kept as they are.
+func markReleaseFailed(clientset kubernetes.Interface, namespace, releaseName string, revision int, description string) error {
+	ctx := context.TODO()
+	secrets := clientset.CoreV1().Secrets(namespace)
+	name := helmReleaseSecretName(releaseName, revision)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get release secret %s: %w", name, err)
+	}
+	if secret.Labels["owner"] != "helm" {
+		return fmt.Errorf("release secret %s is not labelled as owned by Helm", name)
+	}
+	release, err := decodeHelmRelease(secret.Data["release"])
+	if err != nil {
+		return fmt.Errorf("decode release secret %s: %w", name, err)
+	}
+	if release["name"] != releaseName || release["version"] != json.Number(strconv.Itoa(revision)) {
+		return fmt.Errorf("release secret %s does not hold revision %d of release %s", name, revision, releaseName)
+	}
+	info, ok := release["info"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("release secret %s has no release info", name)
+	}
+	info["status"] = helmStatusFailed
+	info["description"] = description
+	data, err := encodeHelmRelease(release)
+	if err != nil {
+		return fmt.Errorf("encode release secret %s: %w", name, err)
+	}
+	secret.Data["release"] = data
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels["status"] = helmStatusFailed
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("update release secret %s: %w", name, err)
+	}
+	return nil
+}
+
+// decodeHelmRelease decodes a release as stored by Helm: base64 encoded,
+// gzipped JSON. Numbers are kept as json.Number so that they are encoded
+// again exactly as they were.
+func decodeHelmRelease(data []byte) (map[string]interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no release data")
+	}
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b, 0x08}) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		b, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var release map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	err = decoder.Decode(&release)
+	if err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// encodeHelmRelease encodes a release the way Helm stores it.
+func encodeHelmRelease(release map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(release)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+func TestMarkReleaseFailed(t *testing.T) {
+	release := map[string]interface{}{
+		"name":    "app",
+		"version": float64(3),
+		"info": map[string]interface{}{
+			"status":        "pending-upgrade",
+			"description":   "Preparing upgrade",
+			"last_deployed": "2023-06-10T12:00:00Z",
+		},
+		"manifest": "kind: Deployment\n",
+	}
+	data, err := encodeHelmRelease(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release["version"] = float64(2)
+	otherData, err := encodeHelmRelease(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		existing []runtime.Object
+		wantErr  bool
+	}{
+		"pending release": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "sh.helm.release.v1.app.v3",
+					Namespace: "foo-dev",
+					Labels:    map[string]string{"name": "app", "owner": "helm", "status": "pending-upgrade", "version": "3"},
+				},
+				Data: map[string][]byte{"release": data},
+			}},
+		},
+		"missing secret": {
+			wantErr: true,
+		},
+		"invalid release data": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.app.v3", Namespace: "foo-dev", Labels: map[string]string{"owner": "helm"}},
+				Data:       map[string][]byte{"release": []byte("not base64!")},
+			}},
+			wantErr: true,
+		},
+		"not owned by Helm": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.app.v3", Namespace: "foo-dev"},
+				Data:       map[string][]byte{"release": data},
+			}},
+			wantErr: true,
+		},
+		"other revision": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.app.v3", Namespace: "foo-dev", Labels: map[string]string{"owner": "helm"}},
+				Data:       map[string][]byte{"release": otherData},
+			}},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tc.existing...)
+			err := markReleaseFailed(clientset, "foo-dev", "app", 3, "Marked as failed")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := clientset.CoreV1().Secrets("foo-dev").Get(context.TODO(), "sh.helm.release.v1.app.v3", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := secret.Labels["status"]; got != "failed" {
+				t.Fatalf("want status label failed, got %s", got)
+			}
+			got, err := decodeHelmRelease(secret.Data["release"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{
+				"name":    "app",
+				"version": json.Number("3"),
+				"info": map[string]interface{}{
+					"status":        "failed",
+					"description":   "Marked as failed",
+					"last_deployed": "2023-06-10T12:00:00Z",
+				},
+				"manifest": "kind: Deployment\n",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("release mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMarkReleaseFailedHelmFixture(t *testing.T) {
+	b, err := os.ReadFile("../../test/testdata/fixtures/helm/release-secret.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret corev1.Secret
+	err = yaml.Unmarshal(b, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := decodeHelmRelease(secret.Data["release"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset := fake.NewSimpleClientset(&secret)
+	err = markReleaseFailed(clientset, "foo-dev", "app", 3, "Marked as failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := clientset.CoreV1().Secrets("foo-dev").Get(context.TODO(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{"modifiedAt": "1686398403", "name": "app", "owner": "helm", "status": "failed", "version": "3"}
+	if diff := cmp.Diff(wantLabels, updated.Labels); diff != "" {
+		t.Fatalf("labels mismatch (-want +got):\n%s", diff)
+	}
+	got, err := decodeHelmRelease(updated.Data["release"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only status and description may change, everything else (including
+	// numbers which do not fit into a float64) is kept as is.
+	info := want["info"].(map[string]interface{})
+	info["status"] = "failed"
+	info["description"] = "Marked as failed"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("release mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRecoverPendingReleaseLockGuard(t *testing.T) {
+	tests := map[string]struct {
+		// Whether another pipeline run holds the lock.
+		otherHolder bool
+		// Error returned when getting the Lease.
+		leaseErr     error
+		wantRollback bool
+	}{
+		"not locked": {
+			wantRollback: true,
+		},
+		"locked by other pipeline run": {
+			otherHolder: true,
+		},
+		"lock cannot be checked": {
+			leaseErr: apierrors.NewForbidden(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "ods-helm-lock-app", nil),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Fake helm binary printing a stuck release history and
+			// recording rollbacks.
+			dir := t.TempDir()
+			historyFile := filepath.Join(dir, "history.json")
+			updated := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+			err := os.WriteFile(historyFile, []byte(`[{"revision":2,"status":"deployed","updated":"`+updated+`"},{"revision":3,"status":"pending-upgrade","updated":"`+updated+`"}]`), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rollbackFile := filepath.Join(dir, "rollback")
+			helmScript := filepath.Join(dir, "helm")
+			script := "#!/bin/sh\ncase \"$*\" in\n*rollback*) touch " + rollbackFile + " ;;\n*) cat " + historyFile + " ;;\nesac\n"
+			err = os.WriteFile(helmScript, []byte(script), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientset := fake.NewSimpleClientset()
+			if tc.otherHolder {
+				leases := clientset.CoordinationV1().Leases("foo-dev")
+				_, err := acquireReleaseLock(leases, "ods-helm-lock-app", "foo-cd/run-2", 10*time.Millisecond, time.Second, t.Logf)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.leaseErr != nil {
+				clientset.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.leaseErr
+				})
+			}
+			d := &deployHelm{
+				logger: testLogger(),
+				// The lock option is enabled, but the lock is not held
+				// (e.g. as leases are forbidden).
+				opts: options{
+					releaseLock:             true,
+					pendingReleasePolicy:    pendingPolicyRollback,
+					pendingReleaseThreshold: time.Minute,
+				},
+				helmBin:          helmScript,
+				releaseName:      "app",
+				releaseNamespace: "foo-dev",
+				targetConfig:     &targetEnvironment{},
+				targetClientset:  clientset,
+				ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+			}
+			_, err = recoverPendingRelease()(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(rollbackFile)
+			if gotRollback := err == nil; gotRollback != tc.wantRollback {
+				t.Fatalf("want rollback: %v, got: %v", tc.wantRollback, gotRollback)
+			}
+		})
+	}
+}
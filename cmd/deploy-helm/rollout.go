@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline/pkg/logging"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// helmReleaseNameAnnotation is the annotation Helm sets on all resources of a release.
+const helmReleaseNameAnnotation = "meta.helm.sh/release-name"
+
+// podProblemReasons are the reasons of waiting containers which are
+// reported while watching a rollout.
+var podProblemReasons = []string{
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"InvalidImageName",
+	"CrashLoopBackOff",
+	"CreateContainerConfigError",
+	"CreateContainerError",
+}
+
+// rolloutWatcher reports the progress of the workloads of a release while
+// it is upgraded, based on informers on the release namespace.
+type rolloutWatcher struct {
+	logger       logging.LeveledLoggerInterface
+	releaseName  string
+	factory      informers.SharedInformerFactory
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	daemonSets   appslisters.DaemonSetLister
+	jobs         batchlisters.JobLister
+	pods         corelisters.PodLister
+	// Last reported progress per workload.
+	progress map[string]string
+	// Pod problems which have been reported already.
+	problems map[string]bool
+}
+
+func newRolloutWatcher(clientset kubernetes.Interface, namespace, releaseName string, logger logging.LeveledLoggerInterface) *rolloutWatcher {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	return &rolloutWatcher{
+		logger:       logger,
+		releaseName:  releaseName,
+		factory:      factory,
+		deployments:  factory.Apps().V1().Deployments().Lister(),
+		statefulSets: factory.Apps().V1().StatefulSets().Lister(),
+		daemonSets:   factory.Apps().V1().DaemonSets().Lister(),
+		jobs:         factory.Batch().V1().Jobs().Lister(),
+		pods:         factory.Core().V1().Pods().Lister(),
+		progress:     map[string]string{},
+		problems:     map[string]bool{},
+	}
+}
+
+// watch starts the informers and logs progress updates every interval.
+// The returned function stops watching: it waits until reporting has
+// finished and shuts the informers down, so that nothing is logged after it
+// returns.
+func (w *rolloutWatcher) watch(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.factory.Start(ctx.Done())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, ok := range w.factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				return
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Both channels may be ready, in which case select picks
+				// one at random.
+				if ctx.Err() != nil {
+					return
+				}
+				for _, line := range w.report() {
+					w.logger.Infof("%s", line)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		w.factory.Shutdown()
+	}
+}
+
+// report returns progress updates since the last report. A workload is
+// reported while it is not ready, and once more when it becomes ready.
+// Pod problems are reported once.
+func (w *rolloutWatcher) report() []string {
+	lines := []string{}
+	for _, ws := range w.workloads() {
+		key := fmt.Sprintf("%s/%s", strings.ToLower(ws.Kind), ws.Name)
+		progress := fmt.Sprintf("%s %d/%d ready", key, ws.ReadyReplicas, ws.DesiredReplicas)
+		if ws.Kind != "Job" && ws.UpdatedReplicas < ws.DesiredReplicas {
+			progress += fmt.Sprintf(", %d/%d updated", ws.UpdatedReplicas, ws.DesiredReplicas)
+		}
+		if !ws.Ready || w.progress[key] != progress {
+			lines = append(lines, progress)
+		}
+		w.progress[key] = progress
+
+		for _, problem := range podProblems(ws.pods) {
+			// Messages change over time (e.g. back-off durations).
+			problemKey := strings.SplitN(problem, " (", 2)[0]
+			if !w.problems[problemKey] {
+				w.problems[problemKey] = true
+				lines = append(lines, problem)
+			}
+		}
+	}
+	return lines
+}
+
+// workloads returns the status of all workloads of the release found in
+// the informer caches, ordered by kind and name.
+func (w *rolloutWatcher) workloads() []workloadStatus {
+	statuses := []workloadStatus{}
+	add := func(kind string, meta metav1.ObjectMeta, selector *metav1.LabelSelector, set func(ws *workloadStatus)) {
+		if meta.Annotations[helmReleaseNameAnnotation] != w.releaseName {
+			return
+		}
+		ws := workloadStatus{Kind: kind, Name: meta.Name, Namespace: meta.Namespace}
+		set(&ws)
+		if selector != nil {
+			if s, err := metav1.LabelSelectorAsSelector(selector); err == nil {
+				pods, _ := w.pods.Pods(meta.Namespace).List(s)
+				for _, p := range pods {
+					ws.pods = append(ws.pods, *p)
+				}
+			}
+		}
+		statuses = append(statuses, ws)
+	}
+	if deployments, err := w.deployments.List(labels.Everything()); err == nil {
+		for _, d := range deployments {
+			add("Deployment", d.ObjectMeta, d.Spec.Selector, func(ws *workloadStatus) { setDeploymentStatus(d, ws) })
+		}
+	}
+	if statefulSets, err := w.statefulSets.List(labels.Everything()); err == nil {
+		for _, s := range statefulSets {
+			add("StatefulSet", s.ObjectMeta, s.Spec.Selector, func(ws *workloadStatus) { setStatefulSetStatus(s, ws) })
+		}
+	}
+	if daemonSets, err := w.daemonSets.List(labels.Everything()); err == nil {
+		for _, ds := range daemonSets {
+			add("DaemonSet", ds.ObjectMeta, ds.Spec.Selector, func(ws *workloadStatus) { setDaemonSetStatus(ds, ws) })
+		}
+	}
+	if jobs, err := w.jobs.List(labels.Everything()); err == nil {
+		for _, j := range jobs {
+			add("Job", j.ObjectMeta, j.Spec.Selector, func(ws *workloadStatus) { setJobStatus(j, ws) })
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Kind != statuses[j].Kind {
+			return statuses[i].Kind < statuses[j].Kind
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// podProblems describes the containers of pods which wait for a reason
+// listed in podProblemReasons.
+func podProblems(pods []corev1.Pod) []string {
+	problems := []string{}
+	for _, p := range pods {
+		statuses := append(append([]corev1.ContainerStatus{}, p.Status.InitContainerStatuses...), p.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.State.Waiting == nil || !containsString(podProblemReasons, cs.State.Waiting.Reason) {
+				continue
+			}
+			problem := fmt.Sprintf("pod/%s container %s: %s", p.Name, cs.Name, cs.State.Waiting.Reason)
+			if cs.State.Waiting.Message != "" {
+				problem += fmt.Sprintf(" (%s)", cs.State.Waiting.Message)
+			}
+			problems = append(problems, problem)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
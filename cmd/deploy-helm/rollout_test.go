@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRolloutWatcherReport(t *testing.T) {
+	replicas := int32(3)
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foo"}}
+	releaseAnnotations := map[string]string{helmReleaseNameAnnotation: "foo"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "foo-dev", Annotations: releaseAnnotations},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Selector: selector},
+		Status:     appsv1.DeploymentStatus{Replicas: 3, ReadyReplicas: 1, UpdatedReplicas: 3, AvailableReplicas: 1},
+	}
+	clientset := fake.NewSimpleClientset(
+		deployment,
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "foo-dev"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-1", Namespace: "foo-dev", Labels: map[string]string{"app": "foo"}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason: "ImagePullBackOff", Message: "Back-off pulling image foo:abc",
+				}},
+			}}},
+		},
+	)
+	w := newRolloutWatcher(clientset, "foo-dev", "foo", testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.factory.Start(ctx.Done())
+	w.factory.WaitForCacheSync(ctx.Done())
+
+	want := []string{
+		"deployment/foo 1/3 ready",
+		"pod/foo-1 container app: ImagePullBackOff (Back-off pulling image foo:abc)",
+	}
+	if diff := cmp.Diff(want, w.report()); diff != "" {
+		t.Fatalf("first report mismatch (-want +got):\n%s", diff)
+	}
+	// Pod problems are reported only once, unready workloads on every report.
+	want = []string{"deployment/foo 1/3 ready"}
+	if diff := cmp.Diff(want, w.report()); diff != "" {
+		t.Fatalf("second report mismatch (-want +got):\n%s", diff)
+	}
+	// Ready workloads are reported once.
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 3, ReadyReplicas: 3, UpdatedReplicas: 3, AvailableReplicas: 3}
+	err := w.factory.Apps().V1().Deployments().Informer().GetStore().Update(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"deployment/foo 3/3 ready"}
+	if diff := cmp.Diff(want, w.report()); diff != "" {
+		t.Fatalf("third report mismatch (-want +got):\n%s", diff)
+	}
+	if got := w.report(); len(got) > 0 {
+		t.Fatalf("want no further report, got: %v", got)
+	}
+}
+
+func TestRolloutWatcherStop(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	w := newRolloutWatcher(clientset, "foo-dev", "foo", testLogger())
+	stop := w.watch(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+}
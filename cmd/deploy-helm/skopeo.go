@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -9,7 +10,36 @@ import (
 	"github.com/opendevstack/ods-pipeline/pkg/artifact"
 )
 
-func (d *deployHelm) copyImage(imageArtifact artifact.Image, destRegistryToken string, outWriter, errWriter io.Writer) error {
+// promotedImage is an image copied into the release namespace.
+type promotedImage struct {
+	Name string `json:"name"`
+	// Ref is the reference of the image in the release namespace.
+	Ref string `json:"ref"`
+	// TLSVerify is whether the registry of the image is TLS verified.
+	TLSVerify bool `json:"tlsVerify"`
+}
+
+// destRegistryToken returns the token to access the destination registry,
+// which is the token used to access the target cluster.
+func (d *deployHelm) destRegistryToken() (string, error) {
+	if d.targetConfig.APIServer != "" {
+		// Only the token of the external cluster is valid for its registry.
+		return d.targetConfig.APIToken, nil
+	}
+	token := d.restConfig.BearerToken
+	if token == "" {
+		t, err := getTrimmedFileContent(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("get token from file %s: %w", tokenFile, err)
+		}
+		token = t
+	}
+	d.redactor.Add(token)
+	return token, nil
+}
+
+// copyImage copies the image into the release namespace.
+func (d *deployHelm) copyImage(imageArtifact artifact.Image, destRegistryToken string, outWriter, errWriter io.Writer) (*promotedImage, error) {
 	imageStream := imageArtifact.Name
 	d.logger.Infof("Copying image %s ...", imageStream)
 	srcImageURL := imageArtifact.Ref
@@ -51,9 +81,37 @@ func (d *deployHelm) copyImage(imageArtifact artifact.Image, destRegistryToken s
 	args = append(
 		args, fmt.Sprintf("docker://%s", srcImageURL), fmt.Sprintf("docker://%s", destImageURL),
 	)
-	err := command.Run("skopeo", args, []string{}, outWriter, errWriter)
+	_, err := command.RunContext(context.TODO(), "skopeo", args, command.Options{
+		Stdout:         outWriter,
+		Stderr:         errWriter,
+		Classification: skopeoClassification,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("skopeo copy %s: %w", srcImageURL, withHint(err, skopeoHints))
+	}
+	return &promotedImage{Name: imageStream, Ref: destImageURL, TLSVerify: destRegistryTLSVerify}, nil
+}
+
+// deleteImage deletes the promoted image from the registry.
+func (d *deployHelm) deleteImage(image promotedImage, destRegistryToken string, outWriter, errWriter io.Writer) error {
+	args := []string{"delete", fmt.Sprintf("--tls-verify=%v", image.TLSVerify)}
+	if image.TLSVerify {
+		args = append(args, fmt.Sprintf("--cert-dir=%v", d.opts.certDir))
+	}
+	if destRegistryToken != "" {
+		args = append(args, "--registry-token", destRegistryToken)
+	}
+	if d.opts.debug {
+		args = append(args, "--debug")
+	}
+	args = append(args, fmt.Sprintf("docker://%s", image.Ref))
+	_, err := command.RunContext(context.TODO(), "skopeo", args, command.Options{
+		Stdout:         outWriter,
+		Stderr:         errWriter,
+		Classification: skopeoClassification,
+	})
 	if err != nil {
-		return fmt.Errorf("skopeo copy %s: %w", srcImageURL, err)
+		return fmt.Errorf("skopeo delete %s: %w", image.Ref, withHint(err, skopeoHints))
 	}
 	return nil
 }
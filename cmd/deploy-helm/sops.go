@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+	"sigs.k8s.io/yaml"
+)
+
+const sopsBin = "sops"
+
+// sopsFile is the part of a sops encrypted file describing the keys the
+// content has been encrypted for.
+type sopsFile struct {
+	Sops *sopsMetadata `json:"sops"`
+}
+
+type sopsMetadata struct {
+	sopsKeyGroup
+	KeyGroups []sopsKeyGroup `json:"key_groups"`
+}
+
+type sopsKeyGroup struct {
+	Age     []sopsAgeKey   `json:"age"`
+	PGP     []sopsPGPKey   `json:"pgp"`
+	HCVault []sopsVaultKey `json:"hc_vault"`
+	KMS     []interface{}  `json:"kms"`
+	GCPKMS  []interface{}  `json:"gcp_kms"`
+	AzureKV []interface{}  `json:"azure_kv"`
+}
+
+type sopsAgeKey struct {
+	Recipient string `json:"recipient"`
+}
+
+type sopsPGPKey struct {
+	Fingerprint string `json:"fp"`
+}
+
+type sopsVaultKey struct {
+	VaultAddress string `json:"vault_address"`
+	EnginePath   string `json:"engine_path"`
+	KeyName      string `json:"key_name"`
+}
+
+// importedKeys describes the keys made available to sops.
+type importedKeys struct {
+	// Recipients (public keys) of the imported age identities.
+	ageRecipients []string
+	// Fingerprints of the imported PGP keys.
+	pgpFingerprints []string
+	// Whether a Vault token has been imported.
+	vault bool
+}
+
+// isSecretsFile returns whether filename follows the naming convention of
+// secrets files (secrets.yaml, secrets.<namespace>.yaml).
+func isSecretsFile(filename string) bool {
+	base := filepath.Base(filename)
+	return strings.HasPrefix(base, "secrets") && strings.HasSuffix(base, ".yaml")
+}
+
+// readSopsMetadata reads the sops metadata of given file.
+// If the file is not encrypted by sops, nil is returned.
+func readSopsMetadata(filename string) (*sopsMetadata, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f sopsFile
+	err = yaml.Unmarshal(content, &f)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return f.Sops, nil
+}
+
+// decryptedValues decrypts given file using sops and returns all string
+// values it contains.
+func decryptedValues(filename string, env []string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	err := command.RunRaw(sopsBin, []string{"--decrypt", filename}, env, &stdout, &stderr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var content interface{}
+	err = yaml.Unmarshal(stdout.Bytes(), &content)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return collectStrings(content, []string{}), nil
+}
+
+// collectStrings appends all strings found in v to values.
+func collectStrings(v interface{}, values []string) []string {
+	switch t := v.(type) {
+	case string:
+		values = append(values, t)
+	case map[string]interface{}:
+		for _, item := range t {
+			values = collectStrings(item, values)
+		}
+	case []interface{}:
+		for _, item := range t {
+			values = collectStrings(item, values)
+		}
+	}
+	return values
+}
+
+// missingRecipients checks whether any of the keys sops can use to decrypt
+// the file described by m has been imported. If so, or if m uses keys which
+// cannot be checked (such as cloud KMS), nil is returned. Otherwise, all
+// recipients of the file are returned.
+func (m *sopsMetadata) missingRecipients(keys importedKeys) []string {
+	missing := []string{}
+	for _, g := range append([]sopsKeyGroup{m.sopsKeyGroup}, m.KeyGroups...) {
+		if len(g.KMS) > 0 || len(g.GCPKMS) > 0 || len(g.AzureKV) > 0 {
+			return nil
+		}
+		for _, k := range g.Age {
+			if containsString(keys.ageRecipients, k.Recipient) {
+				return nil
+			}
+			missing = append(missing, "age recipient "+k.Recipient)
+		}
+		for _, k := range g.PGP {
+			if containsFingerprint(keys.pgpFingerprints, k.Fingerprint) {
+				return nil
+			}
+			missing = append(missing, "PGP key "+k.Fingerprint)
+		}
+		for _, k := range g.HCVault {
+			if keys.vault {
+				return nil
+			}
+			missing = append(missing, fmt.Sprintf(
+				"Vault key %s/v1/%s/keys/%s",
+				strings.TrimSuffix(k.VaultAddress, "/"), k.EnginePath, k.KeyName,
+			))
+		}
+	}
+	return missing
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFingerprint checks if fp matches any of the fingerprints.
+// sops may also refer to a key by its (long) key ID, which is a suffix of
+// the fingerprint.
+func containsFingerprint(fingerprints []string, fp string) bool {
+	fp = strings.ToUpper(strings.ReplaceAll(fp, " ", ""))
+	if fp == "" {
+		return false
+	}
+	for _, f := range fingerprints {
+		if strings.HasSuffix(strings.ToUpper(f), fp) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadSopsMetadata(t *testing.T) {
+	m, err := readSopsMetadata("../../test/testdata/workspaces/helm-sample-app/chart/secrets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("want sops metadata, got none")
+	}
+	want := []sopsAgeKey{{Recipient: "age16374vlt75r8pf9ay7lhdmqlu590sn3zrvvzrkftyveqfpp6x59hseww6ed"}}
+	if diff := cmp.Diff(want, m.Age); diff != "" {
+		t.Fatalf("age keys mismatch (-want +got):\n%s", diff)
+	}
+
+	m, err = readSopsMetadata("../../test/testdata/workspaces/helm-sample-app/chart/values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != nil {
+		t.Fatalf("want no sops metadata, got %v", m)
+	}
+}
+
+func TestMissingRecipients(t *testing.T) {
+	tests := map[string]struct {
+		metadata sopsMetadata
+		keys     importedKeys
+		want     []string
+	}{
+		"matching age recipient": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				Age: []sopsAgeKey{{Recipient: "age1a"}, {Recipient: "age1b"}},
+			}},
+			keys: importedKeys{ageRecipients: []string{"age1b"}},
+			want: nil,
+		},
+		"no age key imported": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				Age: []sopsAgeKey{{Recipient: "age1a"}, {Recipient: "age1b"}},
+			}},
+			keys: importedKeys{},
+			want: []string{"age recipient age1a", "age recipient age1b"},
+		},
+		"other age key imported": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				Age: []sopsAgeKey{{Recipient: "age1a"}},
+			}},
+			keys: importedKeys{ageRecipients: []string{"age1c"}},
+			want: []string{"age recipient age1a"},
+		},
+		"matching PGP key ID": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				PGP: []sopsPGPKey{{Fingerprint: "b1f1c0f5d8e1a1b2"}},
+			}},
+			keys: importedKeys{pgpFingerprints: []string{"FBC7B9E2A4F9289AC0C1D4843D16CEE4B1F1C0F5D8E1A1B2"}},
+			want: nil,
+		},
+		"PGP key missing": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				Age: []sopsAgeKey{{Recipient: "age1a"}},
+				PGP: []sopsPGPKey{{Fingerprint: "ABCDEF"}},
+			}},
+			keys: importedKeys{pgpFingerprints: []string{"123456"}},
+			want: []string{"age recipient age1a", "PGP key ABCDEF"},
+		},
+		"Vault token imported": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				HCVault: []sopsVaultKey{{VaultAddress: "https://vault.example.com", EnginePath: "sops", KeyName: "foo"}},
+			}},
+			keys: importedKeys{vault: true},
+			want: nil,
+		},
+		"Vault token missing": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				HCVault: []sopsVaultKey{{VaultAddress: "https://vault.example.com/", EnginePath: "sops", KeyName: "foo"}},
+			}},
+			keys: importedKeys{},
+			want: []string{"Vault key https://vault.example.com/v1/sops/keys/foo"},
+		},
+		"key groups": {
+			metadata: sopsMetadata{KeyGroups: []sopsKeyGroup{
+				{Age: []sopsAgeKey{{Recipient: "age1a"}}},
+				{Age: []sopsAgeKey{{Recipient: "age1b"}}},
+			}},
+			keys: importedKeys{ageRecipients: []string{"age1b"}},
+			want: nil,
+		},
+		"cloud KMS cannot be checked": {
+			metadata: sopsMetadata{sopsKeyGroup: sopsKeyGroup{
+				Age: []sopsAgeKey{{Recipient: "age1a"}},
+				KMS: []interface{}{map[string]interface{}{"arn": "arn:aws:kms:foo"}},
+			}},
+			keys: importedKeys{},
+			want: nil,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tc.metadata.missingRecipients(tc.keys)
+			if len(tc.want) == 0 && len(got) == 0 {
+				return
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("missing recipients mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParsePGPFingerprints(t *testing.T) {
+	out := `sec:u:4096:1:3D16CEE4B1F1C0F5:1638100000:::u:::scESC:::+:::23::0:
+fpr:::::::::FBC7B9E2A4F9289AC0C1D4843D16CEE4B1F1C0F5:
+grp:::::::::1C8F1D7D4C9A7F2F1A5E52C5E4B6A8C1D2E3F4A5:
+uid:u::::1638100000::ABCDEF::Foo <foo@example.com>::::::::::0:
+ssb:u:4096:1:8E1A1B2C3D4E5F60:1638100000::::::e:::+:::23:
+fpr:::::::::0A1B2C3D4E5F60718293A4B58E1A1B2C3D4E5F60:
+`
+	want := []string{"FBC7B9E2A4F9289AC0C1D4843D16CEE4B1F1C0F5", "0A1B2C3D4E5F60718293A4B58E1A1B2C3D4E5F60"}
+	if diff := cmp.Diff(want, parsePGPFingerprints(out)); diff != "" {
+		t.Fatalf("fingerprints mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxWorkloadEvents is the maximum number of warning events reported per workload.
+const maxWorkloadEvents = 10
+
+// workloadStatus describes the health of a workload of the release.
+type workloadStatus struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Whether the workload is fully rolled out and ready (for Jobs: complete).
+	Ready bool `json:"ready"`
+	// Desired number of replicas (for Jobs: completions).
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Number of ready replicas (for Jobs: succeeded pods).
+	ReadyReplicas     int32 `json:"readyReplicas"`
+	UpdatedReplicas   int32 `json:"updatedReplicas,omitempty"`
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+	// Number of failed pods (only for Jobs).
+	FailedPods int32            `json:"failedPods,omitempty"`
+	Images     []containerImage `json:"images,omitempty"`
+	Events     []workloadEvent  `json:"events,omitempty"`
+	// Error which prevented gathering the status.
+	Error string `json:"error,omitempty"`
+	// Pods of the workload.
+	pods []corev1.Pod
+}
+
+// containerImage describes the image a container of a workload runs.
+type containerImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	// Image ID as reported by the container runtime, including the digest.
+	ImageID string `json:"imageID,omitempty"`
+}
+
+// workloadEvent is a warning event of a workload or one of its pods.
+type workloadEvent struct {
+	Object  string      `json:"object"`
+	Reason  string      `json:"reason"`
+	Message string      `json:"message"`
+	Count   int32       `json:"count,omitempty"`
+	Time    metav1.Time `json:"time"`
+}
+
+// workloadStatuses gathers the status of all Deployments, StatefulSets,
+// DaemonSets and Jobs in objects. Objects without namespace are looked up
+// in namespace. Failures to gather the status of a single workload are
+// recorded in its status.
+func workloadStatuses(clientset kubernetes.Interface, namespace string, objects []manifestObject) []workloadStatus {
+	ctx := context.TODO()
+	statuses := []workloadStatus{}
+	warnings := map[string][]corev1.Event{}
+	for _, o := range objects {
+		ws := workloadStatus{Kind: o.GetKind(), Name: o.GetName(), Namespace: o.GetNamespace()}
+		if ws.Namespace == "" {
+			ws.Namespace = namespace
+		}
+		var selector *metav1.LabelSelector
+		var err error
+		switch o.GetKind() {
+		case "Deployment":
+			selector, err = deploymentStatus(ctx, clientset, &ws)
+		case "StatefulSet":
+			selector, err = statefulSetStatus(ctx, clientset, &ws)
+		case "DaemonSet":
+			selector, err = daemonSetStatus(ctx, clientset, &ws)
+		case "Job":
+			selector, err = jobStatus(ctx, clientset, &ws)
+		default:
+			continue
+		}
+		if err != nil {
+			ws.Error = err.Error()
+			statuses = append(statuses, ws)
+			continue
+		}
+		pods, err := selectPods(ctx, clientset, ws.Namespace, selector)
+		if err != nil {
+			ws.Error = fmt.Sprintf("list pods: %s", err)
+			statuses = append(statuses, ws)
+			continue
+		}
+		ws.pods = pods
+		ws.Images = podImages(pods)
+		if _, ok := warnings[ws.Namespace]; !ok {
+			events, err := clientset.CoreV1().Events(ws.Namespace).List(ctx, metav1.ListOptions{
+				FieldSelector: "type=" + corev1.EventTypeWarning,
+			})
+			if err != nil {
+				ws.Error = fmt.Sprintf("list events: %s", err)
+				statuses = append(statuses, ws)
+				continue
+			}
+			warnings[ws.Namespace] = events.Items
+		}
+		ws.Events = relatedEvents(warnings[ws.Namespace], ws.Kind, ws.Name, pods)
+		statuses = append(statuses, ws)
+	}
+	return statuses
+}
+
+func deploymentStatus(ctx context.Context, clientset kubernetes.Interface, ws *workloadStatus) (*metav1.LabelSelector, error) {
+	d, err := clientset.AppsV1().Deployments(ws.Namespace).Get(ctx, ws.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	setDeploymentStatus(d, ws)
+	return d.Spec.Selector, nil
+}
+
+func statefulSetStatus(ctx context.Context, clientset kubernetes.Interface, ws *workloadStatus) (*metav1.LabelSelector, error) {
+	s, err := clientset.AppsV1().StatefulSets(ws.Namespace).Get(ctx, ws.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	setStatefulSetStatus(s, ws)
+	return s.Spec.Selector, nil
+}
+
+func daemonSetStatus(ctx context.Context, clientset kubernetes.Interface, ws *workloadStatus) (*metav1.LabelSelector, error) {
+	ds, err := clientset.AppsV1().DaemonSets(ws.Namespace).Get(ctx, ws.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	setDaemonSetStatus(ds, ws)
+	return ds.Spec.Selector, nil
+}
+
+func jobStatus(ctx context.Context, clientset kubernetes.Interface, ws *workloadStatus) (*metav1.LabelSelector, error) {
+	j, err := clientset.BatchV1().Jobs(ws.Namespace).Get(ctx, ws.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	setJobStatus(j, ws)
+	return j.Spec.Selector, nil
+}
+
+func setDeploymentStatus(d *appsv1.Deployment, ws *workloadStatus) {
+	ws.DesiredReplicas = replicasOrDefault(d.Spec.Replicas)
+	ws.ReadyReplicas = d.Status.ReadyReplicas
+	ws.UpdatedReplicas = d.Status.UpdatedReplicas
+	ws.AvailableReplicas = d.Status.AvailableReplicas
+	ws.Ready = d.Status.ObservedGeneration >= d.Generation &&
+		d.Status.UpdatedReplicas == ws.DesiredReplicas &&
+		d.Status.AvailableReplicas == ws.DesiredReplicas &&
+		d.Status.ReadyReplicas == ws.DesiredReplicas &&
+		d.Status.Replicas == ws.DesiredReplicas
+}
+
+func setStatefulSetStatus(s *appsv1.StatefulSet, ws *workloadStatus) {
+	ws.DesiredReplicas = replicasOrDefault(s.Spec.Replicas)
+	ws.ReadyReplicas = s.Status.ReadyReplicas
+	ws.UpdatedReplicas = s.Status.UpdatedReplicas
+	ws.AvailableReplicas = s.Status.AvailableReplicas
+	ws.Ready = s.Status.ObservedGeneration >= s.Generation &&
+		s.Status.UpdatedReplicas == ws.DesiredReplicas &&
+		s.Status.ReadyReplicas == ws.DesiredReplicas
+}
+
+func setDaemonSetStatus(ds *appsv1.DaemonSet, ws *workloadStatus) {
+	ws.DesiredReplicas = ds.Status.DesiredNumberScheduled
+	ws.ReadyReplicas = ds.Status.NumberReady
+	ws.UpdatedReplicas = ds.Status.UpdatedNumberScheduled
+	ws.AvailableReplicas = ds.Status.NumberAvailable
+	ws.Ready = ds.Status.ObservedGeneration >= ds.Generation &&
+		ds.Status.UpdatedNumberScheduled == ws.DesiredReplicas &&
+		ds.Status.NumberReady == ws.DesiredReplicas
+}
+
+func setJobStatus(j *batchv1.Job, ws *workloadStatus) {
+	ws.DesiredReplicas = replicasOrDefault(j.Spec.Completions)
+	ws.ReadyReplicas = j.Status.Succeeded
+	ws.FailedPods = j.Status.Failed
+	for _, c := range j.Status.Conditions {
+		if c.Type == batchv1.JobComplete && c.Status == corev1.ConditionTrue {
+			ws.Ready = true
+		}
+	}
+}
+
+// replicasOrDefault returns the given replicas, defaulting to 1 like K8s does.
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// selectPods lists the pods matching selector.
+func selectPods(ctx context.Context, clientset kubernetes.Interface, namespace string, selector *metav1.LabelSelector) ([]corev1.Pod, error) {
+	if selector == nil {
+		return []corev1.Pod{}, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// podImages returns the distinct images the containers of pods run.
+func podImages(pods []corev1.Pod) []containerImage {
+	seen := map[containerImage]bool{}
+	images := []containerImage{}
+	for _, p := range pods {
+		statuses := append(append([]corev1.ContainerStatus{}, p.Status.InitContainerStatuses...), p.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			ci := containerImage{Container: cs.Name, Image: cs.Image, ImageID: cs.ImageID}
+			if !seen[ci] {
+				seen[ci] = true
+				images = append(images, ci)
+			}
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Container != images[j].Container {
+			return images[i].Container < images[j].Container
+		}
+		return images[i].ImageID < images[j].ImageID
+	})
+	return images
+}
+
+// relatedEvents returns the most recent warning events concerning the
+// workload of given kind and name, or one of its pods.
+func relatedEvents(events []corev1.Event, kind, name string, pods []corev1.Pod) []workloadEvent {
+	podNames := map[string]bool{}
+	for _, p := range pods {
+		podNames[p.Name] = true
+	}
+	related := []workloadEvent{}
+	for _, e := range events {
+		if e.Type != corev1.EventTypeWarning {
+			continue
+		}
+		obj := e.InvolvedObject
+		if !(obj.Kind == kind && obj.Name == name) && !(obj.Kind == "Pod" && podNames[obj.Name]) {
+			continue
+		}
+		t := e.LastTimestamp
+		if t.IsZero() {
+			t = metav1.NewTime(e.EventTime.Time)
+		}
+		related = append(related, workloadEvent{
+			Object:  obj.Kind + "/" + obj.Name,
+			Reason:  e.Reason,
+			Message: e.Message,
+			Count:   e.Count,
+			Time:    t,
+		})
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		return related[j].Time.Before(&related[i].Time)
+	})
+	if len(related) > maxWorkloadEvents {
+		related = related[:maxWorkloadEvents]
+	}
+	return related
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkloadStatuses(t *testing.T) {
+	replicas := int32(2)
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foo"}}
+	eventTime := metav1.NewTime(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "foo-dev"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Selector: selector},
+			Status:     appsv1.DeploymentStatus{Replicas: 2, ReadyReplicas: 1, UpdatedReplicas: 2, AvailableReplicas: 1},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-1", Namespace: "foo-dev", Labels: map[string]string{"app": "foo"}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "foo", Image: "foo:abc", ImageID: "registry/foo@sha256:123"},
+			}},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-2", Namespace: "foo-dev", Labels: map[string]string{"app": "foo"}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "foo", Image: "foo:abc", ImageID: "registry/foo@sha256:123"},
+			}},
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "foo-2.1", Namespace: "foo-dev"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "foo-2"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container",
+			Count:          3,
+			LastTimestamp:  eventTime,
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "bar.1", Namespace: "foo-dev"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "bar"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			LastTimestamp:  eventTime,
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "foo-dev"},
+			Status: batchv1.JobStatus{
+				Succeeded:  1,
+				Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+			},
+		},
+	)
+	objects, err := parseManifest(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := workloadStatuses(clientset, "foo-dev", objects)
+	want := []workloadStatus{
+		{
+			Kind: "Deployment", Name: "foo", Namespace: "foo-dev",
+			Ready: false, DesiredReplicas: 2, ReadyReplicas: 1, UpdatedReplicas: 2, AvailableReplicas: 1,
+			Images: []containerImage{{Container: "foo", Image: "foo:abc", ImageID: "registry/foo@sha256:123"}},
+			Events: []workloadEvent{{
+				Object: "Pod/foo-2", Reason: "BackOff", Message: "Back-off restarting failed container",
+				Count: 3, Time: eventTime,
+			}},
+		},
+		{
+			Kind: "Job", Name: "migrate", Namespace: "foo-dev",
+			Ready: true, DesiredReplicas: 1, ReadyReplicas: 1,
+			Images: []containerImage{},
+			Events: []workloadEvent{},
+		},
+		{
+			Kind: "StatefulSet", Name: "db", Namespace: "foo-dev",
+			Error: `statefulsets.apps "db" not found`,
+		},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(workloadStatus{})); diff != "" {
+		t.Fatalf("status mismatch (-want +got):\n%s", diff)
+	}
+}
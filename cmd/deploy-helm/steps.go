@@ -9,15 +9,22 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/opendevstack/ods-pipeline-helm/internal/command"
 	"github.com/opendevstack/ods-pipeline-helm/internal/file"
 	"github.com/opendevstack/ods-pipeline/pkg/artifact"
 	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -28,6 +35,7 @@ const (
 type DeployStep func(d *deployHelm) (*deployHelm, error)
 
 func (d *deployHelm) runSteps(steps ...DeployStep) error {
+	defer d.cleanup()
 	var skip *skipRemainingSteps
 	var err error
 	for _, step := range steps {
@@ -37,12 +45,48 @@ func (d *deployHelm) runSteps(steps ...DeployStep) error {
 				d.logger.Infof(err.Error())
 				return nil
 			}
+			d.runFailureSteps()
 			return err
 		}
 	}
 	return nil
 }
 
+// onFailure registers steps which run if any of the subsequent steps fails.
+// Errors of those steps are logged, but the error of the failed step is
+// returned by runSteps.
+func onFailure(steps ...DeployStep) DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		d.failureSteps = append(d.failureSteps, steps...)
+		return d, nil
+	}
+}
+
+// runFailureSteps runs all steps registered via onFailure.
+func (d *deployHelm) runFailureSteps() {
+	for _, step := range d.failureSteps {
+		_, err := step(d)
+		if err != nil {
+			d.logger.Warnf("Could not gather diagnostics: %s", d.redactor.String(err.Error()))
+		}
+	}
+	d.failureSteps = nil
+}
+
+// addCleanup registers fn to run once all steps are done, regardless of
+// whether they succeeded, failed or skipped the remaining steps.
+func (d *deployHelm) addCleanup(fn func()) {
+	d.cleanupFuncs = append(d.cleanupFuncs, fn)
+}
+
+// cleanup runs all registered cleanup functions in reverse order.
+func (d *deployHelm) cleanup() {
+	for i := len(d.cleanupFuncs) - 1; i >= 0; i-- {
+		d.cleanupFuncs[i]()
+	}
+	d.cleanupFuncs = nil
+}
+
 func setupContext() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
 		ctxt := &pipelinectxt.ODSContext{}
@@ -52,12 +96,26 @@ func setupContext() DeployStep {
 		}
 		d.ctxt = ctxt
 
-		clientset, err := newInClusterClientset()
+		config, kubeconfigNamespace, err := newPipelineRestConfig(d.opts.kubeconfig, d.opts.kubeContext)
+		if err != nil {
+			return d, fmt.Errorf("create Kubernetes config: %w", err)
+		}
+		d.restConfig = config
+		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
 			return d, fmt.Errorf("create Kubernetes clientset: %w", err)
 		}
 		d.clientset = clientset
 
+		if d.opts.pipelineNamespace != "" {
+			d.ctxt.Namespace = d.opts.pipelineNamespace
+		} else if d.ctxt.Namespace == "" {
+			d.ctxt.Namespace = kubeconfigNamespace
+		}
+		if d.ctxt.Namespace == "" {
+			return d, errors.New("pipeline namespace is unknown, set it via -pipeline-namespace")
+		}
+
 		err = os.MkdirAll(pipelinectxt.DeploymentsPath, 0755)
 		if err != nil {
 			return d, fmt.Errorf("create artifact path: %w", err)
@@ -67,6 +125,30 @@ func setupContext() DeployStep {
 	}
 }
 
+// initResults writes the initial value of all Tekton results so that they
+// are available to subsequent tasks even if the deployment is skipped.
+func initResults() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		results := []struct {
+			path  string
+			value string
+		}{
+			{d.opts.releaseNamespaceResultPath, d.opts.namespace},
+			{d.opts.upgradedResultPath, "false"},
+			{d.opts.revisionResultPath, ""},
+			{d.opts.statusResultPath, ""},
+			{d.opts.imagesPromotedResultPath, "false"},
+		}
+		for _, r := range results {
+			err := writeResult(r.path, r.value)
+			if err != nil {
+				return d, fmt.Errorf("write result %s: %w", r.path, err)
+			}
+		}
+		return d, nil
+	}
+}
+
 func skipOnEmptyNamespace() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
 		if d.opts.namespace == "" {
@@ -86,24 +168,14 @@ func setReleaseTarget() DeployStep {
 		}
 		d.logger.Infof("Release name: %s", d.releaseName)
 
-		// Target environment configuration
-		targetConfig := &targetEnvironment{
-			APIServer:    d.opts.apiServer,
-			Namespace:    d.opts.namespace,
-			RegistryHost: d.opts.registryHost,
-		}
-		if targetConfig.APIServer != "" {
-			token, err := tokenFromSecret(d.clientset, d.ctxt.Namespace, d.opts.apiCredentialsSecret)
-			if err != nil {
-				return d, fmt.Errorf("get API token from secret %s: %w", d.opts.apiCredentialsSecret, err)
-			}
-			targetConfig.APIToken = token
+		err := d.setTargetEnvironment()
+		if err != nil {
+			return d, err
 		}
-		d.targetConfig = targetConfig
 
 		// Release namespace
-		d.releaseNamespace = targetConfig.Namespace
-		pattern := "^[a-z][a-z0-9-]{0,61}[a-z]$"
+		d.releaseNamespace = d.targetConfig.Namespace
+		pattern := "^[a-z][a-z0-9-]{0,61}[a-z0-9]$"
 		matched, err := regexp.MatchString(pattern, d.releaseNamespace)
 		if err != nil || !matched {
 			return d, fmt.Errorf("release namespace: %s must match %s", d.releaseNamespace, pattern)
@@ -114,6 +186,49 @@ func setReleaseTarget() DeployStep {
 	}
 }
 
+// setTargetEnvironment configures the target environment and the clientset
+// to access it.
+func (d *deployHelm) setTargetEnvironment() error {
+	targetConfig, err := d.newTargetEnvironment()
+	if err != nil {
+		return err
+	}
+	d.targetConfig = targetConfig
+	d.targetClientset = d.clientset
+	if targetConfig.APIServer != "" {
+		d.targetClientset, err = newTargetClientset(d.restConfig, targetConfig)
+		if err != nil {
+			return fmt.Errorf("create target clientset: %w", err)
+		}
+	}
+	return nil
+}
+
+// newTargetEnvironment returns the configuration of the target environment.
+func (d *deployHelm) newTargetEnvironment() (*targetEnvironment, error) {
+	targetConfig := &targetEnvironment{
+		APIServer:    d.opts.apiServer,
+		Namespace:    d.opts.namespace,
+		RegistryHost: d.opts.registryHost,
+	}
+	if targetConfig.APIServer != "" {
+		targetConfig.Insecure = d.opts.apiInsecureSkipTLSVerify
+		if targetConfig.Insecure {
+			d.logger.Warnf("TLS verification of API server %s is disabled.", targetConfig.APIServer)
+		}
+		err := readTargetCredentials(d.clientset, d.ctxt.Namespace, d.opts.apiCredentialsSecret, targetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("get API credentials from secret %s: %w", d.opts.apiCredentialsSecret, err)
+		}
+		d.redactor.Add(targetConfig.APIToken, string(targetConfig.KeyData))
+		err = d.writeTargetKubeconfig(targetConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return targetConfig, nil
+}
+
 func detectSubrepos() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
 		subrepos, err := pipelinectxt.DetectSubrepos()
@@ -141,28 +256,31 @@ func copyImagesIntoReleaseNamespace() DeployStep {
 		if len(d.imageDigests) == 0 {
 			return d, nil
 		}
-		// Get destination registry token from secret or file in pod.
-		var destRegistryToken string
-		if d.targetConfig.APIToken != "" {
-			destRegistryToken = d.targetConfig.APIToken
-		} else {
-			token, err := getTrimmedFileContent(tokenFile)
-			if err != nil {
-				return d, fmt.Errorf("get token from file %s: %w", tokenFile, err)
-			}
-			destRegistryToken = token
+		destRegistryToken, err := d.destRegistryToken()
+		if err != nil {
+			return d, err
 		}
 
 		d.logger.Infof("Copying images into release namespace ...")
+		promoted := []promotedImage{}
 		for _, artifactFile := range d.imageDigests {
 			imageArtifact, err := artifact.ReadFromFile(artifactFile)
 			if err != nil {
 				return d, fmt.Errorf("read image artifact %s: %w", artifactFile, err)
 			}
-			err = d.copyImage(*imageArtifact, destRegistryToken, os.Stdout, os.Stderr)
+			image, err := d.copyImage(*imageArtifact, destRegistryToken, os.Stdout, os.Stderr)
 			if err != nil {
 				return d, fmt.Errorf("copy image %s: %w", imageArtifact.Name, err)
 			}
+			promoted = append(promoted, *image)
+		}
+		err = d.recordPromotedImages(promoted)
+		if err != nil {
+			return d, err
+		}
+		err = writeResult(d.opts.imagesPromotedResultPath, "true")
+		if err != nil {
+			return d, fmt.Errorf("write images promoted result: %w", err)
 		}
 
 		return d, nil
@@ -219,7 +337,7 @@ func packageHelmChartWithSubcharts() DeployStep {
 			if d.releaseName == d.ctxt.Component {
 				d.cliValues = append(d.cliValues, fmt.Sprintf("--set=%s.fullnameOverride=%s", hc.Name, hc.Name))
 			}
-			helmArchive, err := packageHelmChart(subchart, gitCommitSHA, d.opts.debug)
+			helmArchive, err := packageHelmChart(subchart, gitCommitSHA, "", d.opts.debug)
 			if err != nil {
 				return d, fmt.Errorf("package Helm chart of %s: %w", subrepo, err)
 			}
@@ -243,7 +361,7 @@ func packageHelmChartWithSubcharts() DeployStep {
 		}
 
 		d.logger.Infof("Packaging Helm chart ...")
-		helmArchive, err := packageHelmChart(d.opts.chartDir, d.ctxt.GitCommitSHA, d.opts.debug)
+		helmArchive, err := packageHelmChart(d.opts.chartDir, d.ctxt.GitCommitSHA, "", d.opts.debug)
 		if err != nil {
 			return d, fmt.Errorf("package Helm chart: %w", err)
 		}
@@ -256,12 +374,7 @@ func collectValuesFiles() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
 		d.logger.Infof("Collecting Helm values files ...")
 		d.valuesFiles = []string{}
-		valuesFilesCandidates := []string{
-			fmt.Sprintf("%s/secrets.yaml", d.opts.chartDir), // equivalent values.yaml is added automatically by Helm
-			fmt.Sprintf("%s/values.%s.yaml", d.opts.chartDir, d.targetConfig.Namespace),
-			fmt.Sprintf("%s/secrets.%s.yaml", d.opts.chartDir, d.targetConfig.Namespace),
-		}
-		for _, vfc := range valuesFilesCandidates {
+		for _, vfc := range d.valuesFilesCandidates(d.opts.chartDir) {
 			if _, err := os.Stat(vfc); os.IsNotExist(err) {
 				d.logger.Infof("%s is not present, skipping.", vfc)
 			} else {
@@ -273,25 +386,73 @@ func collectValuesFiles() DeployStep {
 	}
 }
 
-func importAgeKey() DeployStep {
+func importKeys() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
-		if len(d.opts.ageKeySecret) == 0 {
-			d.logger.Infof("Skipping import of age key for helm-secrets as parameter is not set ...")
-			return d, nil
+		d.sopsEnv = []string{}
+		for _, p := range keyProviders {
+			if !p.configured(d.opts) {
+				d.logger.Infof("Skipping import of %s key for helm-secrets as parameter is not set ...", p.name())
+				continue
+			}
+			d.logger.Infof("Importing %s key for helm-secrets ...", p.name())
+			env, imported, err := p.importKey(d)
+			if err != nil {
+				return d, fmt.Errorf("import %s key: %w", p.name(), err)
+			}
+			if imported {
+				d.sopsEnv = append(d.sopsEnv, env...)
+			}
 		}
-		d.logger.Infof("Storing age key for helm-secrets ...")
-		secret, err := d.clientset.CoreV1().Secrets(d.ctxt.Namespace).Get(
-			context.TODO(), d.opts.ageKeySecret, metav1.GetOptions{},
-		)
-		if err != nil {
-			d.logger.Infof("No secret %q found in namespace %q, skipping.", d.opts.ageKeySecret, d.ctxt.Namespace)
-			return d, nil
+		return d, nil
+	}
+}
+
+func checkSecretsDecryptable() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		for _, vf := range d.valuesFiles {
+			if !isSecretsFile(vf) {
+				continue
+			}
+			m, err := readSopsMetadata(vf)
+			if err != nil {
+				return d, fmt.Errorf("read sops metadata of %s: %w", vf, err)
+			}
+			if m == nil {
+				d.logger.Infof("%s is not encrypted by sops.", vf)
+				continue
+			}
+			missing := m.missingRecipients(d.importedKeys)
+			if len(missing) > 0 {
+				return d, fmt.Errorf(
+					"%s cannot be decrypted as no matching key has been imported, need one of: %s",
+					vf, strings.Join(missing, ", "),
+				)
+			}
 		}
-		err = storeAgeKey(secret.Data[d.opts.ageKeySecretField])
-		if err != nil {
-			return d, fmt.Errorf("store age key: %w", err)
+		return d, nil
+	}
+}
+
+func redactSecretValues() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		for _, vf := range d.valuesFiles {
+			if !isSecretsFile(vf) {
+				continue
+			}
+			m, err := readSopsMetadata(vf)
+			if err != nil {
+				return d, fmt.Errorf("read sops metadata of %s: %w", vf, err)
+			}
+			if m == nil {
+				continue
+			}
+			values, err := decryptedValues(vf, d.sopsEnv)
+			if err != nil {
+				return d, fmt.Errorf("decrypt %s: %w", vf, err)
+			}
+			d.redactor.Add(values...)
+			d.logger.Infof("Registered %d values of %s for redaction.", len(values), vf)
 		}
-		d.logger.Infof("Age key secret %s stored.", d.opts.ageKeySecret)
 		return d, nil
 	}
 }
@@ -315,14 +476,36 @@ func diffHelmRelease() DeployStep {
 		if err != nil {
 			return d, fmt.Errorf("helm diff: %w", err)
 		}
+		d.changeClass = changeClassNone
+		if !inSync {
+			changes := classifyDiff(diffStdoutBuf.String())
+			for _, c := range changes {
+				d.logger.Infof("Change: %s", c)
+			}
+			d.changeClass = highestChangeClass(changes)
+			// Be conservative if the changes cannot be identified.
+			if d.changeClass == changeClassNone {
+				d.changeClass = changeClassConfig
+			}
+		}
+		d.logger.Infof("Change class: %s", d.changeClass)
+		err = writeResult(d.opts.changeClassResultPath, d.changeClass.String())
+		if err != nil {
+			return d, fmt.Errorf("write change class result: %w", err)
+		}
 		if d.opts.diffOnly {
 			return d, &skipRemainingSteps{"Only diff was requested, skipping helm upgrade."}
 		}
 		if inSync {
+			err := d.writeRevisionResults()
+			if err != nil {
+				return d, err
+			}
 			return d, &skipRemainingSteps{"No diff detected, skipping helm upgrade."}
 		}
 
-		err = writeDeploymentArtifact(diffStdoutBuf.Bytes(), "diff", d.opts.chartDir, d.targetConfig.Namespace)
+		d.diff = diffStdoutBuf.Bytes()
+		err = writeDeploymentArtifact(d.diff, "diff", d.opts.chartDir, d.targetConfig.Namespace)
 		if err != nil {
 			return d, fmt.Errorf("write diff artifact: %w", err)
 		}
@@ -330,6 +513,115 @@ func diffHelmRelease() DeployStep {
 	}
 }
 
+func checkDestructiveChanges() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if d.changeClass != changeClassDestructive {
+			return d, nil
+		}
+		switch d.opts.onDestructiveChange {
+		case destructiveChangeAllow:
+			d.logger.Warnf("Destructive changes detected, continuing as they are allowed.")
+			return d, nil
+		case destructiveChangeStop:
+			return d, &skipRemainingSteps{"Destructive changes detected, skipping helm upgrade."}
+		case destructiveChangeFail:
+			return d, errors.New("destructive changes detected, refusing to upgrade")
+		}
+		return d, fmt.Errorf(
+			"unknown action %q for destructive changes, must be one of: %s, %s, %s",
+			d.opts.onDestructiveChange, destructiveChangeAllow, destructiveChangeStop, destructiveChangeFail,
+		)
+	}
+}
+
+func awaitApproval() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.requireApproval {
+			return d, nil
+		}
+		threshold, err := parseChangeClass(d.opts.approvalThreshold)
+		if err != nil {
+			return d, fmt.Errorf("approval threshold: %w", err)
+		}
+		if d.changeClass < threshold {
+			d.logger.Infof("Change class %s is below approval threshold %s, no approval required.", d.changeClass, threshold)
+			return d, nil
+		}
+		d.logger.Infof("Requesting approval of diff for release %s in %s ...", d.releaseName, d.releaseNamespace)
+		err = d.unlockWhile(func() error {
+			return d.requestApproval(d.diff, approvalPollInterval, d.opts.approvalTimeout)
+		})
+		if err != nil {
+			return d, fmt.Errorf("approval: %w", err)
+		}
+		return d, nil
+	}
+}
+
+func detectDrift() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		d.logger.Infof("Checking Helm release %s in %s for drift ...", d.releaseName, d.releaseNamespace)
+		revision, err := d.releaseRevision()
+		if err != nil {
+			return d, fmt.Errorf("get release revision: %w", err)
+		}
+		d.logger.Infof(
+			"Deployed revision: %d (%s), chart %s, app version %s",
+			revision.Revision, revision.Status, revision.Chart, revision.AppVersion,
+		)
+		manifest, err := d.releaseManifest()
+		if err != nil {
+			return d, fmt.Errorf("get release manifest: %w", err)
+		}
+		released, err := parseManifest(manifest)
+		if err != nil {
+			return d, fmt.Errorf("parse release manifest: %w", err)
+		}
+
+		report := newDriftReport()
+		dynamicClient, mapper, err := newTargetDynamicClient(d.restConfig, d.targetConfig)
+		if err != nil {
+			return d, err
+		}
+		report.live, err = compareLive(dynamicClient, mapper, d.releaseNamespace, released)
+		if err != nil {
+			return d, fmt.Errorf("compare live objects: %w", err)
+		}
+
+		if len(d.subrepos) > 0 {
+			report.chartSkipped = "the chart depends on charts of subrepositories which are only available when packaged."
+		} else {
+			report.chart, report.chartSkipped, err = d.compareDeployedChart(revision.AppVersion, released)
+			if err != nil {
+				return d, err
+			}
+		}
+		if report.chartSkipped != "" {
+			d.logger.Warnf("Release manifest not compared to chart: %s", report.chartSkipped)
+		}
+
+		content := d.redactor.String(fmt.Sprintf(
+			"Release %s in %s, revision %d (%s), chart %s\n\n%s",
+			d.releaseName, d.releaseNamespace, revision.Revision, revision.Status, revision.Chart, report,
+		))
+		fmt.Print(content)
+		err = writeDeploymentArtifact([]byte(content), "drift", d.opts.chartDir, d.releaseNamespace)
+		if err != nil {
+			return d, fmt.Errorf("write drift artifact: %w", err)
+		}
+		err = writeResult(d.opts.driftDetectedResultPath, strconv.FormatBool(report.detected()))
+		if err != nil {
+			return d, fmt.Errorf("write drift detected result: %w", err)
+		}
+		if report.detected() {
+			d.logger.Warnf("Drift detected in release %s.", d.releaseName)
+		} else {
+			d.logger.Infof("No drift detected in release %s.", d.releaseName)
+		}
+		return d, nil
+	}
+}
+
 func upgradeHelmRelease() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
 		d.logger.Infof("Upgrading Helm release to %s...", d.helmArchive)
@@ -338,34 +630,190 @@ func upgradeHelmRelease() DeployStep {
 			return d, fmt.Errorf("assemble helm upgrade args: %w", err)
 		}
 		printlnSafeHelmCmd(helmUpgradeArgs, os.Stdout)
+		stopWatching := func() {}
+		if d.opts.progressInterval > 0 {
+			stopWatching = newRolloutWatcher(d.targetClientset, d.releaseNamespace, d.releaseName, d.logger).watch(d.opts.progressInterval)
+		}
 		err = d.helmUpgrade(helmUpgradeArgs, os.Stdout, os.Stderr)
+		stopWatching()
 		if err != nil {
 			return d, fmt.Errorf("helm upgrade: %w", err)
 		}
+		err = writeResult(d.opts.upgradedResultPath, "true")
+		if err != nil {
+			return d, fmt.Errorf("write upgraded result: %w", err)
+		}
+		err = d.writeRevisionResults()
+		if err != nil {
+			return d, err
+		}
 		return d, nil
 	}
 }
 
-func gatherHelmStatus() DeployStep {
+func rollbackHelmRelease() DeployStep {
 	return func(d *deployHelm) (*deployHelm, error) {
-		if d.opts.gatherStatus {
-			d.logger.Infof("Gathering Helm status of release %s...", d.releaseName)
+		d.logger.Infof("Rolling back Helm release %s ...", d.releaseName)
+		err := d.helmRollback(d.opts.rollbackRevision, d.opts.rollbackFlags, os.Stdout, os.Stderr)
+		if err != nil {
+			return d, fmt.Errorf("helm rollback: %w", err)
+		}
+		return d, nil
+	}
+}
 
-			fn := artifactFilename("release-"+d.releaseName, d.opts.chartDir, d.releaseNamespace) + ".yaml"
-			f, err := os.Create(filepath.Join(pipelinectxt.DeploymentsPath, fn))
-			if err != nil {
-				return d, fmt.Errorf("create file for helm status: %w", err)
+// writeReleaseRevision writes the current revision and status of the
+// release to the respective Tekton results.
+func writeReleaseRevision() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		return d, d.writeRevisionResults()
+	}
+}
+
+func runReadinessChecks() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		filename := d.opts.readinessChecksFile
+		if filename == "" {
+			filename = filepath.Join(d.opts.chartDir, readinessChecksFilename)
+		}
+		config, err := readReadinessChecksConfig(filename)
+		if err != nil {
+			return d, fmt.Errorf("read readiness checks %s: %w", filename, err)
+		}
+		if config == nil || len(config.Checks) == 0 {
+			d.logger.Infof("No readiness checks configured in %s.", filename)
+			return d, nil
+		}
+		interval, err := parseDurationOrDefault(config.Interval, defaultReadinessCheckInterval)
+		if err != nil {
+			return d, fmt.Errorf("parse readiness check interval: %w", err)
+		}
+		dynamicClient, mapper, err := newTargetDynamicClient(d.restConfig, d.targetConfig)
+		if err != nil {
+			return d, err
+		}
+		checker := &readinessChecker{dynamicClient: dynamicClient, mapper: mapper, namespace: d.releaseNamespace}
+		failed := []string{}
+		for _, c := range config.Checks {
+			d.logger.Infof("Running readiness check %s ...", c.Name)
+			result := checker.run(context.Background(), c, interval)
+			d.readinessResults = append(d.readinessResults, result)
+			if result.Ready {
+				d.logger.Infof("Readiness check %s passed after %s: %s", c.Name, result.Duration, result.Message)
+			} else {
+				d.logger.Warnf("Readiness check %s failed after %s: %s", c.Name, result.Duration, result.Message)
+				failed = append(failed, c.Name)
 			}
+		}
+		if len(failed) > 0 {
+			return d, fmt.Errorf("readiness checks failed: %s", strings.Join(failed, ", "))
+		}
+		return d, nil
+	}
+}
 
-			err = d.helmStatus([]string{d.releaseName, "-o", "yaml"}, f, os.Stderr)
+func gatherHelmStatus() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if d.opts.gatherStatus {
+			err := d.writeStatusArtifact()
 			if err != nil {
-				return d, fmt.Errorf("helm status: %w", err)
+				return d, err
 			}
 		}
 		return d, nil
 	}
 }
 
+// writeStatusArtifact writes the Helm status of the release, enriched with
+// the status of its workloads, as an artifact.
+func (d *deployHelm) writeStatusArtifact() error {
+	d.logger.Infof("Gathering Helm status of release %s...", d.releaseName)
+
+	var stdout bytes.Buffer
+	err := d.helmStatus([]string{d.releaseName, "-o", "yaml"}, &stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("helm status: %w", err)
+	}
+	status := map[string]interface{}{}
+	err = yaml.Unmarshal(stdout.Bytes(), &status)
+	if err != nil {
+		return fmt.Errorf("unmarshal helm status: %w", err)
+	}
+
+	d.logger.Infof("Gathering status of workloads of release %s...", d.releaseName)
+	workloads, err := d.releaseWorkloads()
+	if err != nil {
+		d.logger.Warnf("Could not gather workload status: %s", err)
+	} else {
+		for _, w := range workloads {
+			if !w.Ready {
+				d.logger.Warnf("%s/%s is not ready (%d/%d replicas ready).", w.Kind, w.Name, w.ReadyReplicas, w.DesiredReplicas)
+			}
+		}
+		status["workloads"] = workloads
+	}
+	if len(d.readinessResults) > 0 {
+		status["readinessChecks"] = d.readinessResults
+	}
+
+	content, err := yaml.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("marshal status: %w", err)
+	}
+	// The status includes the values of the release, which may be secret.
+	content = []byte(d.redactor.String(string(content)))
+	fn := artifactFilename("release-"+d.releaseName, d.opts.chartDir, d.releaseNamespace) + ".yaml"
+	err = os.WriteFile(filepath.Join(pipelinectxt.DeploymentsPath, fn), content, 0644)
+	if err != nil {
+		return fmt.Errorf("write helm status: %w", err)
+	}
+	return nil
+}
+
+// releaseWorkloads returns the status of the workloads of the release.
+func (d *deployHelm) releaseWorkloads() ([]workloadStatus, error) {
+	manifest, err := d.releaseManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get release manifest: %w", err)
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("parse release manifest: %w", err)
+	}
+	return workloadStatuses(d.targetClientset, d.releaseNamespace, objects), nil
+}
+
+// writeRevisionResults writes the current revision and status of the
+// release to the respective Tekton results.
+func (d *deployHelm) writeRevisionResults() error {
+	if d.opts.revisionResultPath == "" && d.opts.statusResultPath == "" {
+		return nil
+	}
+	revision, err := d.releaseRevision()
+	if err != nil {
+		return fmt.Errorf("get release revision: %w", err)
+	}
+	err = writeResult(d.opts.revisionResultPath, strconv.Itoa(revision.Revision))
+	if err != nil {
+		return fmt.Errorf("write revision result: %w", err)
+	}
+	err = writeResult(d.opts.statusResultPath, revision.Status)
+	if err != nil {
+		return fmt.Errorf("write status result: %w", err)
+	}
+	return nil
+}
+
+// valuesFilesCandidates returns the values files which are used for the
+// chart in chartDir if they exist.
+func (d *deployHelm) valuesFilesCandidates(chartDir string) []string {
+	return []string{
+		fmt.Sprintf("%s/secrets.yaml", chartDir), // equivalent values.yaml is added automatically by Helm
+		fmt.Sprintf("%s/values.%s.yaml", chartDir, d.targetConfig.Namespace),
+		fmt.Sprintf("%s/secrets.%s.yaml", chartDir, d.targetConfig.Namespace),
+	}
+}
+
 func getTrimmedFileContent(filename string) (string, error) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
@@ -374,12 +822,48 @@ func getTrimmedFileContent(filename string) (string, error) {
 	return strings.TrimSpace(string(content)), nil
 }
 
-func tokenFromSecret(clientset *kubernetes.Clientset, namespace, name string) (string, error) {
-	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
-	if err != nil {
-		return "", err
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeMaps returns a map with the entries of both a and b. Entries of b
+// take precedence.
+func mergeMaps(a, b map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
 	}
-	return string(secret.Data["token"]), nil
+	return merged
+}
+
+// writeResult writes value to the Tekton result file at path.
+// If path is empty, nothing is written.
+func writeResult(path, value string) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(value), 0644)
 }
 
 func writeDeploymentArtifact(content []byte, filename, chartDir, targetEnv string) error {
@@ -395,12 +879,49 @@ func artifactFilename(filename, chartDir, targetEnv string) string {
 	return fmt.Sprintf("%s-%s", filename, targetEnv)
 }
 
-func newInClusterClientset() (*kubernetes.Clientset, error) {
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
+// releaseConfigMapName returns the name of the ConfigMap with given prefix
+// which belongs to given release.
+func releaseConfigMapName(prefix, releaseName, releaseNamespace string) string {
+	name := fmt.Sprintf("%s-%s-%s", prefix, releaseName, releaseNamespace)
+	if len(name) > 253 {
+		name = strings.TrimRight(name[:253], "-.")
+	}
+	return name
+}
+
+// newTargetRestConfig returns the config to access the target cluster.
+// If no API server is configured, the target is the cluster the task runs in.
+func newTargetRestConfig(pipelineConfig *rest.Config, targetConfig *targetEnvironment) (*rest.Config, error) {
+	if targetConfig.APIServer == "" {
+		return rest.CopyConfig(pipelineConfig), nil
+	}
+	return targetConfig.restConfig(), nil
+}
+
+// newTargetClientset returns a clientset for the target cluster.
+func newTargetClientset(pipelineConfig *rest.Config, targetConfig *targetEnvironment) (kubernetes.Interface, error) {
+	config, err := newTargetRestConfig(pipelineConfig, targetConfig)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("create target cluster config: %w", err)
 	}
-	// creates the clientset
 	return kubernetes.NewForConfig(config)
 }
+
+// newTargetDynamicClient returns a dynamic client for the target cluster
+// together with a REST mapper based on the discovery information of the cluster.
+func newTargetDynamicClient(pipelineConfig *rest.Config, targetConfig *targetEnvironment) (dynamic.Interface, meta.RESTMapper, error) {
+	config, err := newTargetRestConfig(pipelineConfig, targetConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create target cluster config: %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create dynamic client: %w", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create discovery client: %w", err)
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	return dynamicClient, mapper, nil
+}
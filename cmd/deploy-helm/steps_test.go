@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/opendevstack/ods-pipeline/pkg/artifact"
@@ -99,3 +101,35 @@ func TestGetImageURLs(t *testing.T) {
 		})
 	}
 }
+
+func TestInitResults(t *testing.T) {
+	dir := t.TempDir()
+	opts := options{
+		namespace:                  "foo-dev",
+		releaseNamespaceResultPath: filepath.Join(dir, "release-namespace"),
+		upgradedResultPath:         filepath.Join(dir, "upgraded"),
+		revisionResultPath:         filepath.Join(dir, "revision"),
+		statusResultPath:           filepath.Join(dir, "status"),
+		imagesPromotedResultPath:   filepath.Join(dir, "images-promoted"),
+	}
+	_, err := initResults()(&deployHelm{opts: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"release-namespace": "foo-dev",
+		"upgraded":          "false",
+		"revision":          "",
+		"status":            "",
+		"images-promoted":   "false",
+	}
+	for name, value := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			t.Fatalf("result %s: want %q, got %q", name, value, string(got))
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/command"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// promotedImagesArtifactName is the name of the artifact recording the
+	// images promoted into the release namespace.
+	promotedImagesArtifactName = "promoted-images"
+	// promotedImagesConfigMapPrefix is the prefix of the ConfigMap in the
+	// pipeline namespace recording the images promoted into the release
+	// namespace. Unlike the artifact, it is available to later pipeline runs
+	// such as the one tearing down the release.
+	promotedImagesConfigMapPrefix = "ods-helm-promoted-images"
+	// promotedImagesKey is the ConfigMap data key holding the promoted images.
+	promotedImagesKey = "images.json"
+	// promotedImagesNamespaceLabel is the label of the promoted images
+	// ConfigMap holding the release namespace.
+	promotedImagesNamespaceLabel = "opendevstack.org/release-namespace"
+)
+
+// teardownReport records what a teardown removed (or would remove in dry-run mode).
+type teardownReport struct {
+	dryRun           bool
+	releaseRemoved   bool
+	imagesDeleted    []string
+	namespaceDeleted bool
+	notes            []string
+}
+
+func (r *teardownReport) String() string {
+	var sb strings.Builder
+	if r.dryRun {
+		sb.WriteString("Dry run, nothing was removed.\n")
+		fmt.Fprintf(&sb, "Release would be uninstalled: %v\n", r.releaseRemoved)
+		fmt.Fprintf(&sb, "Images that would be deleted: %d\n", len(r.imagesDeleted))
+	} else {
+		fmt.Fprintf(&sb, "Release uninstalled: %v\n", r.releaseRemoved)
+		fmt.Fprintf(&sb, "Images deleted: %d\n", len(r.imagesDeleted))
+	}
+	for _, image := range r.imagesDeleted {
+		fmt.Fprintf(&sb, "  %s\n", image)
+	}
+	if r.dryRun {
+		fmt.Fprintf(&sb, "Namespace would be deleted: %v\n", r.namespaceDeleted)
+	} else {
+		fmt.Fprintf(&sb, "Namespace deleted: %v\n", r.namespaceDeleted)
+	}
+	for _, note := range r.notes {
+		fmt.Fprintf(&sb, "Note: %s\n", note)
+	}
+	return sb.String()
+}
+
+// teardownSteps returns the steps of the uninstall subcommand and the
+// teardown mode of the deploy subcommand.
+func teardownSteps(opts options) []DeployStep {
+	return []DeployStep{
+		setupContext(),
+		setPreviewTarget(),
+		initResults(),
+		skipOnEmptyNamespace(),
+		setReleaseTarget(),
+		lockRelease(),
+		collectPromotedImages(),
+		uninstallHelmRelease(),
+		deletePromotedImages(),
+		deleteReleaseNamespace(),
+		writeUninstallArtifact(),
+	}
+}
+
+// collectPromotedImages starts the teardown report and looks up the images
+// promoted into the release namespace before anything is removed, so that a
+// failing lookup does not leave a half torn down release behind.
+func collectPromotedImages() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		d.teardown = &teardownReport{dryRun: d.opts.dryRun}
+		if !d.opts.deleteImages {
+			return d, nil
+		}
+		images, found, err := d.readPromotedImages()
+		if err != nil {
+			return d, err
+		}
+		if !found {
+			d.logger.Infof(
+				"No promoted images recorded for release %s in namespace %s (neither in ConfigMap %s nor in artifact %s).",
+				d.releaseName, d.releaseNamespace,
+				releaseConfigMapName(promotedImagesConfigMapPrefix, d.releaseName, d.releaseNamespace),
+				d.promotedImagesArtifactPath(),
+			)
+			d.teardown.notes = append(d.teardown.notes, "no promoted images recorded")
+		}
+		d.promotedImages = images
+		return d, nil
+	}
+}
+
+func uninstallHelmRelease() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		d.logger.Infof("Uninstalling Helm release %s ...", d.releaseName)
+		flags := d.opts.uninstallFlags
+		if d.opts.dryRun {
+			flags += " --dry-run"
+		}
+		err := d.helmUninstall(flags, os.Stdout, os.Stderr)
+		if isReleaseNotFound(err) {
+			d.logger.Infof("Release %s not found, nothing to uninstall.", d.releaseName)
+			d.teardown.notes = append(d.teardown.notes, "release was not found")
+			return d, nil
+		}
+		if err != nil {
+			return d, fmt.Errorf("helm uninstall: %w", err)
+		}
+		d.teardown.releaseRemoved = true
+		return d, nil
+	}
+}
+
+// deletePromotedImages deletes the image tags promoted into the release
+// namespace, as collected by collectPromotedImages.
+func deletePromotedImages() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.deleteImages {
+			return d, nil
+		}
+		if len(d.promotedImages) == 0 {
+			d.logger.Infof("No promoted images, nothing to delete.")
+			return d, d.deletePromotedImagesRecord()
+		}
+		token, err := d.destRegistryToken()
+		if err != nil {
+			return d, err
+		}
+		for _, image := range d.promotedImages {
+			d.logger.Infof("Deleting image %s ...", image.Ref)
+			if d.opts.dryRun {
+				d.teardown.imagesDeleted = append(d.teardown.imagesDeleted, image.Ref)
+				continue
+			}
+			err := d.deleteImage(image, token, os.Stdout, os.Stderr)
+			var runErr *command.Error
+			if errors.As(err, &runErr) && runErr.Result.Class == classImageNotFound {
+				d.logger.Infof("Image %s not found, nothing to delete.", image.Ref)
+				continue
+			}
+			if err != nil {
+				return d, fmt.Errorf("delete image %s: %w", image.Name, err)
+			}
+			d.teardown.imagesDeleted = append(d.teardown.imagesDeleted, image.Ref)
+		}
+		return d, d.deletePromotedImagesRecord()
+	}
+}
+
+// deleteReleaseNamespace deletes the release namespace. The namespace the
+// pipeline runs in is never deleted.
+func deleteReleaseNamespace() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		if !d.opts.deleteNamespace {
+			return d, nil
+		}
+		if d.releaseNamespace == d.ctxt.Namespace {
+			return d, fmt.Errorf("refusing to delete namespace %s as the pipeline runs in it", d.releaseNamespace)
+		}
+		d.logger.Infof("Deleting namespace %s ...", d.releaseNamespace)
+		deleteOptions := metav1.DeleteOptions{}
+		if d.opts.dryRun {
+			deleteOptions.DryRun = []string{metav1.DryRunAll}
+		}
+		err := d.targetClientset.CoreV1().Namespaces().Delete(context.TODO(), d.releaseNamespace, deleteOptions)
+		if apierrors.IsNotFound(err) {
+			d.logger.Infof("Namespace %s not found, nothing to delete.", d.releaseNamespace)
+			d.teardown.notes = append(d.teardown.notes, "namespace was not found")
+			return d, nil
+		}
+		if err != nil {
+			return d, fmt.Errorf("delete namespace %s: %w", d.releaseNamespace, err)
+		}
+		d.teardown.namespaceDeleted = true
+		return d, nil
+	}
+}
+
+func writeUninstallArtifact() DeployStep {
+	return func(d *deployHelm) (*deployHelm, error) {
+		content := d.teardown.String()
+		fmt.Print(content)
+		err := writeDeploymentArtifact([]byte(content), "uninstall-"+d.releaseName, d.opts.chartDir, d.releaseNamespace)
+		if err != nil {
+			return d, fmt.Errorf("write uninstall artifact: %w", err)
+		}
+		return d, nil
+	}
+}
+
+// recordPromotedImages records the images promoted into the release
+// namespace so that they can be deleted on teardown. They are written as
+// artifact and merged into the promoted images ConfigMap, which also holds
+// the images promoted by earlier pipeline runs.
+func (d *deployHelm) recordPromotedImages(images []promotedImage) error {
+	err := d.writePromotedImagesArtifact(images)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	configMaps := d.clientset.CoreV1().ConfigMaps(d.ctxt.Namespace)
+	name := releaseConfigMapName(promotedImagesConfigMapPrefix, d.releaseName, d.releaseNamespace)
+	cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("get promoted images ConfigMap %s: %w", name, err)
+	}
+	exists := err == nil
+	if !exists {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "ods-pipeline-helm",
+					promotedImagesNamespaceLabel:   d.releaseNamespace,
+				},
+			},
+			Data: map[string]string{
+				"release":   d.releaseName,
+				"namespace": d.releaseNamespace,
+			},
+		}
+	}
+	recorded := []promotedImage{}
+	if content, ok := cm.Data[promotedImagesKey]; ok {
+		err = json.Unmarshal([]byte(content), &recorded)
+		if err != nil {
+			return fmt.Errorf("unmarshal promoted images ConfigMap %s: %w", name, err)
+		}
+	}
+	content, err := json.Marshal(mergePromotedImages(recorded, images))
+	if err != nil {
+		return fmt.Errorf("marshal promoted images: %w", err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[promotedImagesKey] = string(content)
+	if exists {
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	} else {
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("write promoted images ConfigMap %s: %w", name, err)
+	}
+	return nil
+}
+
+// readPromotedImages reads the images promoted into the release namespace
+// from the promoted images ConfigMap, falling back to the artifact.
+// Whether any record was found is returned as well.
+func (d *deployHelm) readPromotedImages() ([]promotedImage, bool, error) {
+	name := releaseConfigMapName(promotedImagesConfigMapPrefix, d.releaseName, d.releaseNamespace)
+	cm, err := d.clientset.CoreV1().ConfigMaps(d.ctxt.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, false, fmt.Errorf("get promoted images ConfigMap %s: %w", name, err)
+	}
+	if err == nil {
+		var images []promotedImage
+		err = json.Unmarshal([]byte(cm.Data[promotedImagesKey]), &images)
+		if err != nil {
+			return nil, false, fmt.Errorf("unmarshal promoted images ConfigMap %s: %w", name, err)
+		}
+		return images, true, nil
+	}
+	images, err := d.readPromotedImagesArtifact()
+	if err != nil {
+		return nil, false, err
+	}
+	return images, images != nil, nil
+}
+
+// deletePromotedImagesRecord deletes the promoted images ConfigMap once
+// the images have been deleted. Nothing is deleted in dry-run mode.
+func (d *deployHelm) deletePromotedImagesRecord() error {
+	if d.opts.dryRun {
+		return nil
+	}
+	name := releaseConfigMapName(promotedImagesConfigMapPrefix, d.releaseName, d.releaseNamespace)
+	err := d.clientset.CoreV1().ConfigMaps(d.ctxt.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete promoted images ConfigMap %s: %w", name, err)
+	}
+	return nil
+}
+
+// deleteNamespacePromotedImagesRecords deletes the promoted images
+// ConfigMaps of all releases in given release namespace.
+func (d *deployHelm) deleteNamespacePromotedImagesRecords(namespace string, deleteOptions metav1.DeleteOptions) error {
+	configMaps := d.clientset.CoreV1().ConfigMaps(d.ctxt.Namespace)
+	selector := labels.SelectorFromSet(labels.Set{promotedImagesNamespaceLabel: namespace})
+	list, err := configMaps.List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("list promoted images ConfigMaps: %w", err)
+	}
+	for _, cm := range list.Items {
+		if !strings.HasPrefix(cm.Name, promotedImagesConfigMapPrefix) {
+			continue
+		}
+		err := configMaps.Delete(context.TODO(), cm.Name, deleteOptions)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete promoted images ConfigMap %s: %w", cm.Name, err)
+		}
+	}
+	return nil
+}
+
+// mergePromotedImages returns the recorded images followed by the promoted
+// images not recorded yet.
+func mergePromotedImages(recorded, promoted []promotedImage) []promotedImage {
+	seen := map[string]bool{}
+	for _, image := range recorded {
+		seen[image.Ref] = true
+	}
+	merged := recorded
+	for _, image := range promoted {
+		if !seen[image.Ref] {
+			seen[image.Ref] = true
+			merged = append(merged, image)
+		}
+	}
+	return merged
+}
+
+// writePromotedImagesArtifact records the images promoted into the release
+// namespace so that they can be deleted on teardown.
+func (d *deployHelm) writePromotedImagesArtifact(images []promotedImage) error {
+	content, err := json.Marshal(images)
+	if err != nil {
+		return fmt.Errorf("marshal promoted images: %w", err)
+	}
+	err = os.WriteFile(d.promotedImagesArtifactPath(), content, 0644)
+	if err != nil {
+		return fmt.Errorf("write promoted images artifact: %w", err)
+	}
+	return nil
+}
+
+// readPromotedImagesArtifact reads the images promoted into the release
+// namespace from the artifact. If the artifact does not exist, nil is returned.
+func (d *deployHelm) readPromotedImagesArtifact() ([]promotedImage, error) {
+	content, err := os.ReadFile(d.promotedImagesArtifactPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read promoted images artifact: %w", err)
+	}
+	var images []promotedImage
+	err = json.Unmarshal(content, &images)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal promoted images artifact: %w", err)
+	}
+	return images, nil
+}
+
+func (d *deployHelm) promotedImagesArtifactPath() string {
+	fn := artifactFilename(promotedImagesArtifactName, d.opts.chartDir, d.releaseNamespace) + ".json"
+	return filepath.Join(pipelinectxt.DeploymentsPath, fn)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTeardownReport(t *testing.T) {
+	tests := map[string]struct {
+		report teardownReport
+		want   string
+	}{
+		"release uninstalled": {
+			report: teardownReport{releaseRemoved: true},
+			want: `Release uninstalled: true
+Images deleted: 0
+Namespace deleted: false
+`,
+		},
+		"dry run of full teardown": {
+			report: teardownReport{
+				dryRun:           true,
+				releaseRemoved:   true,
+				imagesDeleted:    []string{"registry/foo-pr-1/foo:abc", "registry/foo-pr-1/bar:abc"},
+				namespaceDeleted: true,
+			},
+			want: `Dry run, nothing was removed.
+Release would be uninstalled: true
+Images that would be deleted: 2
+  registry/foo-pr-1/foo:abc
+  registry/foo-pr-1/bar:abc
+Namespace would be deleted: true
+`,
+		},
+		"nothing found": {
+			report: teardownReport{notes: []string{"release was not found", "namespace was not found"}},
+			want: `Release uninstalled: false
+Images deleted: 0
+Namespace deleted: false
+Note: release was not found
+Note: namespace was not found
+`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, tc.report.String()); diff != "" {
+				t.Fatalf("report mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeleteReleaseNamespaceRefusesPipelineNamespace(t *testing.T) {
+	d := &deployHelm{
+		opts:             options{deleteNamespace: true},
+		releaseNamespace: "foo-cd",
+		ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+		teardown:         &teardownReport{},
+	}
+	_, err := deleteReleaseNamespace()(d)
+	if err == nil {
+		t.Fatal("want err, got none")
+	}
+	if d.teardown.namespaceDeleted {
+		t.Fatal("namespace must not be reported as deleted")
+	}
+}
+
+func TestRecordPromotedImages(t *testing.T) {
+	d := &deployHelm{
+		opts:             options{chartDir: "chart"},
+		clientset:        fake.NewSimpleClientset(),
+		releaseName:      "foo",
+		releaseNamespace: "foo-dev",
+		ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+	}
+	chdirTemp(t)
+	if err := os.MkdirAll(pipelinectxt.DeploymentsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	first := []promotedImage{{Name: "foo", Ref: "registry/foo-dev/foo:abc"}}
+	second := []promotedImage{{Name: "foo", Ref: "registry/foo-dev/foo:abc"}, {Name: "foo", Ref: "registry/foo-dev/foo:def"}}
+	for _, images := range [][]promotedImage{first, second} {
+		if err := d.recordPromotedImages(images); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The ConfigMap is used even if the artifact is not available.
+	if err := os.RemoveAll(pipelinectxt.DeploymentsPath); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := d.readPromotedImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("want promoted images to be found")
+	}
+	if diff := cmp.Diff(second, got); diff != "" {
+		t.Fatalf("images mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeletePromotedImages(t *testing.T) {
+	tests := map[string]struct {
+		record     []promotedImage
+		dryRun     bool
+		wantImages []string
+		wantNotes  []string
+		wantRecord bool
+	}{
+		"nothing recorded": {
+			wantNotes: []string{"no promoted images recorded"},
+		},
+		"no images promoted": {
+			record:     []promotedImage{},
+			wantRecord: false,
+		},
+		"dry run": {
+			record:     []promotedImage{{Name: "foo", Ref: "registry/foo-dev/foo:abc"}},
+			dryRun:     true,
+			wantImages: []string{"registry/foo-dev/foo:abc"},
+			wantRecord: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			chdirTemp(t)
+			d := &deployHelm{
+				opts:             options{chartDir: "chart", deleteImages: true, dryRun: tc.dryRun},
+				clientset:        fake.NewSimpleClientset(),
+				releaseName:      "foo",
+				releaseNamespace: "foo-dev",
+				ctxt:             &pipelinectxt.ODSContext{Namespace: "foo-cd"},
+				targetConfig:     &targetEnvironment{APIServer: "https://api.example.com", APIToken: "token"},
+				redactor:         redact.New(),
+				logger:           testLogger(),
+			}
+			if tc.record != nil {
+				if err := os.MkdirAll(pipelinectxt.DeploymentsPath, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.recordPromotedImages(tc.record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := collectPromotedImages()(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = deletePromotedImages()(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.wantNotes, d.teardown.notes); diff != "" {
+				t.Fatalf("notes mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantImages, d.teardown.imagesDeleted); diff != "" {
+				t.Fatalf("deleted images mismatch (-want +got):\n%s", diff)
+			}
+			name := releaseConfigMapName(promotedImagesConfigMapPrefix, d.releaseName, d.releaseNamespace)
+			_, err = d.clientset.CoreV1().ConfigMaps("foo-cd").Get(context.TODO(), name, metav1.GetOptions{})
+			if tc.wantRecord && err != nil {
+				t.Fatalf("want promoted images ConfigMap to be kept, got: %s", err)
+			}
+			if !tc.wantRecord && !apierrors.IsNotFound(err) {
+				t.Fatalf("want promoted images ConfigMap to be deleted, got: %v", err)
+			}
+		})
+	}
+}
+
+// chdirTemp changes the working directory to a temporary directory for the
+// duration of the test.
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// vaultKeyProvider reads a Vault token from a K8s secret so that sops can
+// decrypt values using the Vault transit engine.
+type vaultKeyProvider struct{}
+
+func (p *vaultKeyProvider) name() string {
+	return "Vault"
+}
+
+func (p *vaultKeyProvider) configured(opts options) bool {
+	return len(opts.vaultTokenSecret) > 0
+}
+
+func (p *vaultKeyProvider) importKey(d *deployHelm) ([]string, bool, error) {
+	secret, err := d.keySecret(d.opts.vaultTokenSecret)
+	if err != nil {
+		return nil, false, fmt.Errorf("get secret %s: %w", d.opts.vaultTokenSecret, err)
+	}
+	if secret == nil {
+		d.logger.Infof("No secret %q found in namespace %q, skipping.", d.opts.vaultTokenSecret, d.ctxt.Namespace)
+		return nil, false, nil
+	}
+	token := strings.TrimSpace(string(secret.Data[d.opts.vaultTokenSecretField]))
+	if token == "" {
+		return nil, false, fmt.Errorf("field %s of secret %s is empty", d.opts.vaultTokenSecretField, d.opts.vaultTokenSecret)
+	}
+	d.redactor.Add(token)
+	env := []string{fmt.Sprintf("VAULT_TOKEN=%s", token)}
+	if d.opts.vaultAddr != "" {
+		env = append(env, fmt.Sprintf("VAULT_ADDR=%s", d.opts.vaultAddr))
+	}
+	d.importedKeys.vault = true
+	d.logger.Infof("Vault token secret %s loaded.", d.opts.vaultTokenSecret)
+	return env, true, nil
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// timestampFormat is the format of timestamps decorating output lines.
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// collectOutput copies stdout and stderr of a process to wStdout and
+// wStderr until both are closed. The output is copied as is, regardless of
+// line length. Each stream is copied in order, independently of the other.
+func collectOutput(rcStdout, rcStderr io.Reader, wStdout, wStderr io.Writer) error {
+	var stdoutErr, stderrErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		_, stdoutErr = io.Copy(wStdout, rcStdout)
+		wg.Done()
+	}()
+	_, stderrErr = io.Copy(wStderr, rcStderr)
+	wg.Wait()
+	if stdoutErr != nil || stderrErr != nil {
+		return fmt.Errorf("copy stdout = %v, copy stderr = %v", stdoutErr, stderrErr)
+	}
+	return nil
+}
+
+// decoratingWriter prefixes each line written to w with a timestamp and/or
+// the name of the stream. Apart from the prefixes, the output is written
+// exactly as received, including a final incomplete line.
+type decoratingWriter struct {
+	w         io.Writer
+	stream    string
+	timestamp bool
+	now       func() time.Time
+	// Whether the next byte written starts a new line.
+	lineStart bool
+}
+
+// decorate wraps w in a decoratingWriter if opts requests decoration.
+func decorate(w io.Writer, stream string, opts Options) io.Writer {
+	if !opts.Timestamps && !opts.StreamPrefix {
+		return w
+	}
+	dw := &decoratingWriter{w: w, timestamp: opts.Timestamps, now: time.Now, lineStart: true}
+	if opts.StreamPrefix {
+		dw.stream = stream
+	}
+	return dw
+}
+
+func (dw *decoratingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if dw.lineStart {
+			if _, err := io.WriteString(dw.w, dw.prefix()); err != nil {
+				return written, err
+			}
+			dw.lineStart = false
+		}
+		chunk := p
+		for i, b := range p {
+			if b == '\n' {
+				chunk = p[:i+1]
+				dw.lineStart = true
+				break
+			}
+		}
+		n, err := dw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (dw *decoratingWriter) prefix() string {
+	prefix := ""
+	if dw.timestamp {
+		prefix += dw.now().Format(timestampFormat) + " "
+	}
+	if dw.stream != "" {
+		prefix += "[" + dw.stream + "] "
+	}
+	return prefix
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunOutputIsCopiedExactly(t *testing.T) {
+	longLine := strings.Repeat("x", 100*1024)
+	tests := map[string]struct {
+		script string
+		want   string
+	}{
+		"line longer than 64KiB": {
+			script: "echo " + longLine,
+			want:   longLine + "\n",
+		},
+		"no final newline": {
+			script: "printf 'first\\nsecond'",
+			want:   "first\nsecond",
+		},
+		"empty lines": {
+			script: "printf '\\n\\na\\n'",
+			want:   "\n\na\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := Run("bash", []string{"-c", tc.script}, []string{}, &stdout, &stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, stdout.String()); diff != "" {
+				t.Fatalf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunKeepsOrderPerStream(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := Run("../../test/scripts/interleaved-output.sh", []string{}, []string{}, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("some stdout\nmore stdout\nstdout after sleep\n", stdout.String()); diff != "" {
+		t.Fatalf("stdout mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("some stderr\nmore stderr\nstderr after sleep\n", stderr.String()); diff != "" {
+		t.Fatalf("stderr mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunContextStreamPrefix(t *testing.T) {
+	var out bytes.Buffer
+	_, err := RunContext(context.Background(), "bash", []string{"-c", "printf 'a\\nb'; sleep 0.1; printf 'c' >&2"}, Options{
+		Stdout: &out, Stderr: &out, StreamPrefix: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("[stdout] a\n[stdout] b[stderr] c", out.String()); diff != "" {
+		t.Fatalf("output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecoratingWriter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	w := &decoratingWriter{
+		w: &out, stream: "stderr", timestamp: true, lineStart: true,
+		now: func() time.Time { return now },
+	}
+	for _, p := range []string{"par", "tial\nline\n\n", "end"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "2023-01-01T12:00:00.000Z [stderr] partial\n" +
+		"2023-01-01T12:00:00.000Z [stderr] line\n" +
+		"2023-01-01T12:00:00.000Z [stderr] \n" +
+		"2023-01-01T12:00:00.000Z [stderr] end"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Fatalf("output mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -1,15 +1,23 @@
 package command
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"fmt"
 	"io"
-	"os"
 	"os/exec"
-	"sync"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
 )
 
+// outputRedactor masks sensitive values in the output of all commands.
+var outputRedactor *redact.Redactor
+
+// SetRedactor configures r to mask sensitive values in the output of all
+// subsequently run commands. Passing nil disables redaction.
+func SetRedactor(r *redact.Redactor) {
+	outputRedactor = r
+}
+
 // Run invokes exe with given args and env. Stdout and stderr
 // are streamed to outWriter and errWriter, respectively.
 func Run(exe string, args []string, env []string, outWriter, errWriter io.Writer) error {
@@ -19,31 +27,31 @@ func Run(exe string, args []string, env []string, outWriter, errWriter io.Writer
 // Run invokes exe with given args and env. Stdout and stderr
 // are streamed to outWriter and errWriter, respectively.
 // If dir is non-empty, the workdir of exe will be set to it.
+// Use RunContext to get details about failures.
 func RunInDir(exe string, args []string, env []string, dir string, outWriter, errWriter io.Writer) error {
-	cmd := exec.Command(exe, args...)
-	cmd.Env = append(os.Environ(), env...)
-	cmdStderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("connect stderr pipe: %w", err)
-	}
-	cmdStdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("connect stdout pipe: %w", err)
-	}
-	if dir != "" {
-		cmd.Dir = dir
-	}
-	err = cmd.Start()
-	if err != nil {
-		return fmt.Errorf("start cmd: %w", err)
-	}
+	return run(exe, args, Options{
+		Env: env, Dir: dir, Stdout: outWriter, Stderr: errWriter,
+	})
+}
 
-	err = collectOutput(cmdStdout, cmdStderr, outWriter, errWriter)
-	if err != nil {
-		return fmt.Errorf("collect output: %w", err)
-	}
+// RunRaw is like Run, but does not redact stdout. It is meant for callers
+// which parse the output, and must take care of redacting whatever they
+// print or store of it.
+func RunRaw(exe string, args []string, env []string, outWriter, errWriter io.Writer) error {
+	return run(exe, args, Options{
+		Env: env, Stdout: outWriter, Stderr: errWriter, RawStdout: true,
+	})
+}
 
-	return cmd.Wait()
+// run runs exe via RunContext, returning the underlying error of a failed
+// process.
+func run(exe string, args []string, opts Options) error {
+	_, err := RunContext(context.Background(), exe, args, opts)
+	var runErr *Error
+	if errors.As(err, &runErr) {
+		return runErr.Err
+	}
+	return err
 }
 
 // RunWithSpecialFailureCode invokes exe with given args and env. Stdout and stderr
@@ -61,27 +69,3 @@ func RunWithSpecialFailureCode(exe string, args []string, env []string, outWrite
 	}
 	return true, nil
 }
-
-func collectOutput(rcStdout, rcStderr io.ReadCloser, wStdout, wStderr io.Writer) error {
-	var stdoutErr, stderrErr error
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		stdoutErr = scan(rcStdout, wStdout)
-		wg.Done()
-	}()
-	stderrErr = scan(rcStderr, wStderr)
-	wg.Wait()
-	if stdoutErr != nil || stderrErr != nil {
-		return fmt.Errorf("scan stdout = %s, scan stderr = %s", stdoutErr, stderrErr)
-	}
-	return nil
-}
-
-func scan(rc io.ReadCloser, w io.Writer) error {
-	scanner := bufio.NewScanner(rc)
-	for scanner.Scan() {
-		fmt.Fprintln(w, scanner.Text())
-	}
-	return scanner.Err()
-}
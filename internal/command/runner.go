@@ -0,0 +1,247 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+)
+
+const (
+	// DefaultTailSize is the number of bytes of stdout and stderr kept in
+	// the result if Options.TailSize is not set.
+	DefaultTailSize = 4096
+	// ClassTimeout is the class of processes which exceeded Options.Timeout.
+	ClassTimeout = "timeout"
+)
+
+// Options configures how RunContext runs a process.
+type Options struct {
+	// Env is added to the environment of the current process.
+	Env []string
+	// Dir is the working directory. If empty, the current directory is used.
+	Dir string
+	// Timeout after which the process is killed. Zero means no timeout.
+	Timeout time.Duration
+	// Stdout and Stderr receive the output of the process as it is written.
+	// If nil, the output is only kept in the result tails.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Redactor masks sensitive values in the output and the result tails.
+	// If nil, the redactor configured via SetRedactor is used.
+	Redactor *redact.Redactor
+	// RawStdout passes stdout to Stdout without redaction, for callers
+	// which parse the output. Stderr and the result tails are always
+	// redacted.
+	RawStdout bool
+	// TailSize is the number of trailing bytes of stdout and stderr kept in
+	// the result. Defaults to DefaultTailSize.
+	TailSize int
+	// Classification determines the class of a failed process.
+	Classification Classification
+	// Timestamps prefixes each line written to Stdout and Stderr with the
+	// time it was received.
+	Timestamps bool
+	// StreamPrefix prefixes each line written to Stdout and Stderr with the
+	// name of the stream, e.g. "[stderr] ".
+	StreamPrefix bool
+}
+
+// Classification maps conditions of a failed process to classes, which
+// allow callers to react to specific failures or to give actionable hints.
+type Classification struct {
+	// ExitCodes maps exit codes to classes.
+	ExitCodes map[int]string
+	// Messages maps substrings of the output (stderr or stdout) to classes.
+	// Messages take precedence over exit codes.
+	Messages map[string]string
+}
+
+// Result describes a finished process.
+type Result struct {
+	// ExitCode is the exit code of the process, or -1 if it did not exit
+	// normally (e.g. because it could not be started or was killed).
+	ExitCode int
+	Duration time.Duration
+	// StdoutTail and StderrTail hold the (redacted) end of the output.
+	StdoutTail string
+	StderrTail string
+	// Class is the class of the failure as determined by
+	// Options.Classification, ClassTimeout if the timeout was exceeded, or
+	// empty if the process succeeded or the failure is not classified.
+	Class string
+}
+
+// Success returns whether the process exited with exit code 0.
+func (r *Result) Success() bool {
+	return r.ExitCode == 0
+}
+
+// Error is returned by RunContext if the process fails.
+type Error struct {
+	Exe    string
+	Result *Result
+	// Err is the underlying error, e.g. an *exec.ExitError.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s failed", e.Exe)
+	if e.Result.ExitCode >= 0 {
+		msg = fmt.Sprintf("%s exited with code %d", e.Exe, e.Result.ExitCode)
+	}
+	if e.Result.Class != "" {
+		msg += fmt.Sprintf(" (%s)", e.Result.Class)
+	}
+	if tail := lastLine(e.Result.StderrTail); tail != "" {
+		msg += ": " + tail
+	} else if e.Result.ExitCode < 0 && e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RunContext invokes exe with given args as configured by opts. The process
+// is killed if ctx is done or the timeout is exceeded. A result is always
+// returned. If the process fails, the error is an *Error.
+func RunContext(ctx context.Context, exe string, args []string, opts Options) (*Result, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	redactor := opts.Redactor
+	if redactor == nil {
+		redactor = outputRedactor
+	}
+	tailSize := opts.TailSize
+	if tailSize <= 0 {
+		tailSize = DefaultTailSize
+	}
+	stdoutTail := &tailBuffer{size: tailSize}
+	stderrTail := &tailBuffer{size: tailSize}
+	result := &Result{ExitCode: -1}
+	start := time.Now()
+
+	err := runProcess(ctx, exe, args, opts, redactor, stdoutTail, stderrTail)
+	result.Duration = time.Since(start)
+	result.StdoutTail = redactor.String(stdoutTail.String())
+	result.StderrTail = redactor.String(stderrTail.String())
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+		return result, nil
+	case errors.As(err, &ee):
+		result.ExitCode = ee.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Class = ClassTimeout
+	} else {
+		result.Class = opts.Classification.classify(result)
+	}
+	return result, &Error{Exe: exe, Result: result, Err: err}
+}
+
+func runProcess(ctx context.Context, exe string, args []string, opts Options, redactor *redact.Redactor, stdoutTail, stderrTail io.Writer) error {
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Env = append(os.Environ(), opts.Env...)
+	cmd.Dir = opts.Dir
+	cmdStderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("connect stderr pipe: %w", err)
+	}
+	cmdStdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("connect stdout pipe: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("start cmd: %w", err)
+	}
+
+	// The tails are redacted once the process has finished.
+	outWriter := stdoutTail
+	if opts.Stdout != nil {
+		w := decorate(opts.Stdout, "stdout", opts)
+		if redactor != nil && !opts.RawStdout {
+			redactedWriter := redactor.Writer(w)
+			defer redactedWriter.Flush()
+			w = redactedWriter
+		}
+		outWriter = io.MultiWriter(w, stdoutTail)
+	}
+	errWriter := stderrTail
+	if opts.Stderr != nil {
+		w := decorate(opts.Stderr, "stderr", opts)
+		if redactor != nil {
+			redactedWriter := redactor.Writer(w)
+			defer redactedWriter.Flush()
+			w = redactedWriter
+		}
+		errWriter = io.MultiWriter(w, stderrTail)
+	}
+	err = collectOutput(cmdStdout, cmdStderr, outWriter, errWriter)
+	if err != nil {
+		_ = cmd.Wait()
+		return fmt.Errorf("collect output: %w", err)
+	}
+	return cmd.Wait()
+}
+
+// classify returns the class of the failed process described by r.
+// Messages are checked in lexical order.
+func (c Classification) classify(r *Result) string {
+	messages := make([]string, 0, len(c.Messages))
+	for msg := range c.Messages {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	for _, msg := range messages {
+		if strings.Contains(r.StderrTail, msg) || strings.Contains(r.StdoutTail, msg) {
+			return c.Messages[msg]
+		}
+	}
+	return c.ExitCodes[r.ExitCode]
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = append([]byte{}, t.buf[len(t.buf)-t.size:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// lastLine returns the last non-empty line of s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,144 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-helm/internal/redact"
+)
+
+const exitWithCode = "../../test/scripts/exit-with-code.sh"
+
+func TestRunContext(t *testing.T) {
+	classification := Classification{
+		ExitCodes: map[int]string{2: "drift", 3: "other"},
+		Messages:  map[string]string{"in progress": "pending"},
+	}
+	tests := map[string]struct {
+		args      []string
+		wantCode  int
+		wantClass string
+		wantErr   string
+	}{
+		"success": {
+			args:     []string{"out", "err", "0"},
+			wantCode: 0,
+		},
+		"classified exit code": {
+			args:      []string{"out", "err", "2"},
+			wantCode:  2,
+			wantClass: "drift",
+			wantErr:   exitWithCode + " exited with code 2 (drift): err",
+		},
+		"message takes precedence over exit code": {
+			args:      []string{"out", "'another operation is in progress'", "3"},
+			wantCode:  3,
+			wantClass: "pending",
+			wantErr:   exitWithCode + " exited with code 3 (pending): another operation is in progress",
+		},
+		"unclassified failure": {
+			args:     []string{"out", "err", "1"},
+			wantCode: 1,
+			wantErr:  exitWithCode + " exited with code 1: err",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			result, err := RunContext(context.Background(), exitWithCode, tc.args, Options{
+				Stdout: &stdout, Stderr: &stderr, Classification: classification,
+			})
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				if diff := cmp.Diff(tc.wantErr, err.Error()); diff != "" {
+					t.Fatalf("error mismatch (-want +got):\n%s", diff)
+				}
+				var runErr *Error
+				if !errors.As(err, &runErr) {
+					t.Fatalf("want *Error, got %T", err)
+				}
+			}
+			if result.ExitCode != tc.wantCode {
+				t.Fatalf("want exit code %d, got %d", tc.wantCode, result.ExitCode)
+			}
+			if result.Class != tc.wantClass {
+				t.Fatalf("want class %q, got %q", tc.wantClass, result.Class)
+			}
+			if result.StdoutTail != stdout.String() {
+				t.Fatalf("want stdout tail %q, got %q", stdout.String(), result.StdoutTail)
+			}
+			if result.StderrTail != stderr.String() {
+				t.Fatalf("want stderr tail %q, got %q", stderr.String(), result.StderrTail)
+			}
+		})
+	}
+}
+
+func TestRunContextTail(t *testing.T) {
+	result, err := RunContext(context.Background(), exitWithCode, []string{"0123456789", "", "0"}, Options{TailSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("789\n", result.StdoutTail); diff != "" {
+		t.Fatalf("tail mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunContextRedaction(t *testing.T) {
+	r := redact.New()
+	r.Add("s3cr3t")
+	tests := map[string]struct {
+		rawStdout  bool
+		wantStdout string
+	}{
+		"redacted": {
+			wantStdout: "token=***\n",
+		},
+		"raw stdout": {
+			rawStdout:  true,
+			wantStdout: "token=s3cr3t\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			result, err := RunContext(context.Background(), exitWithCode, []string{"token=s3cr3t", "token=s3cr3t", "0"}, Options{
+				Stdout: &stdout, Stderr: &stderr, Redactor: r, RawStdout: tc.rawStdout,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.wantStdout, stdout.String()); diff != "" {
+				t.Fatalf("output mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("token=***\n", stderr.String()); diff != "" {
+				t.Fatalf("stderr mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("token=***\n", result.StdoutTail); diff != "" {
+				t.Fatalf("tail mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	result, err := RunContext(context.Background(), "sleep", []string{"5"}, Options{Timeout: 100 * time.Millisecond})
+	if err == nil {
+		t.Fatal("want err, got none")
+	}
+	if result.Class != ClassTimeout {
+		t.Fatalf("want class %q, got %q", ClassTimeout, result.Class)
+	}
+	if result.Duration >= 5*time.Second {
+		t.Fatalf("process was not killed, took %s", result.Duration)
+	}
+}
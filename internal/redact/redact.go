@@ -0,0 +1,205 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Mask replaces sensitive values.
+	Mask = "***"
+	// minValueLength is the minimum length of values to redact. Shorter values
+	// (such as "true" or "1") would mask too much unrelated output.
+	minValueLength = 4
+)
+
+var (
+	// helmDiffHeaderPattern matches the line helm-diff prints before the
+	// diff of a resource, e.g. "foo, bar, Secret (v1) has changed:".
+	helmDiffHeaderPattern = regexp.MustCompile(`^\S*, \S+, (\S+) \(\S+\) has (been added|been removed|changed):$`)
+	// kindSecretPattern matches the kind field of a K8s Secret manifest.
+	kindSecretPattern = regexp.MustCompile(`^kind:\s*Secret\s*$`)
+	// dataKeyPattern matches the start of the data block of a K8s Secret manifest.
+	dataKeyPattern = regexp.MustCompile(`^(\s*)(data|stringData):\s*$`)
+	// dataEntryPattern matches an entry within the data block of a K8s Secret manifest.
+	dataEntryPattern = regexp.MustCompile(`^(\s*[^\s:#][^:]*:)(\s+\S.*)?$`)
+	// helmDiffMaskedPattern matches values which helm-diff already masked.
+	helmDiffMaskedPattern = regexp.MustCompile(`^\s*'[-+]+ # \(\d+ bytes\)'\s*$`)
+)
+
+// Redactor masks registered sensitive values.
+// Add and String are safe to call on a nil Redactor, which does not mask
+// any values.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// New creates a Redactor without any registered values.
+func New() *Redactor {
+	return &Redactor{values: map[string]bool{}, replacer: strings.NewReplacer()}
+}
+
+// Add registers values to mask. Multi-line values are registered line by
+// line. Besides the plain values, their base64 encodings are registered as
+// well as K8s Secret manifests carry base64 encoded data.
+func (r *Redactor) Add(values ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minValueLength {
+			r.values[base64.StdEncoding.EncodeToString([]byte(v))] = true
+		}
+		for _, line := range strings.Split(v, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) < minValueLength {
+				continue
+			}
+			r.values[line] = true
+			r.values[base64.StdEncoding.EncodeToString([]byte(line))] = true
+		}
+	}
+	// Replace longer values first so that values containing other values
+	// are masked completely.
+	sorted := make([]string, 0, len(r.values))
+	for v := range r.values {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	oldnew := make([]string, 0, len(sorted)*2)
+	for _, v := range sorted {
+		oldnew = append(oldnew, v, Mask)
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+}
+
+// String masks all registered values in s.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.replacer.Replace(s)
+}
+
+// Writer returns a writer which masks registered values as well as the data
+// of K8s Secret manifests (as printed e.g. by helm-diff or helm --debug)
+// before writing to w. Output is processed line by line, therefore Flush
+// must be called once all output has been written.
+func (r *Redactor) Writer(w io.Writer) *Writer {
+	return &Writer{redactor: r, w: w}
+}
+
+// Writer masks sensitive output line by line, see Redactor.Writer.
+type Writer struct {
+	redactor *Redactor
+	w        io.Writer
+	mu       sync.Mutex
+	buf      []byte
+	// Whether the output is a helm-diff.
+	diff bool
+	// Whether the current manifest is a K8s Secret.
+	inSecret bool
+	// Whether the current line is within the data block of a K8s Secret.
+	inData bool
+	// Indentation of the data key of the current K8s Secret.
+	dataIndent int
+}
+
+// Write buffers p and writes all complete lines, redacted, to the
+// underlying writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if _, err := io.WriteString(w.w, w.redactLine(line)+"\n"); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered incomplete line to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = nil
+	_, err := io.WriteString(w.w, w.redactLine(line))
+	return err
+}
+
+// redactLine masks registered values in line, as well as the line itself if
+// it is part of the data of a K8s Secret manifest.
+func (w *Writer) redactLine(line string) string {
+	line = w.redactor.String(line)
+
+	if m := helmDiffHeaderPattern.FindStringSubmatch(line); m != nil {
+		w.diff = true
+		w.inSecret = m[1] == "Secret"
+		w.inData = false
+		return line
+	}
+	prefix, body := "", line
+	if w.diff && len(line) >= 2 && strings.ContainsAny(line[:1], " +-") {
+		prefix, body = line[:2], line[2:]
+	}
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "---" {
+		w.inSecret = false
+		w.inData = false
+		return line
+	}
+	if kindSecretPattern.MatchString(trimmed) {
+		w.inSecret = true
+		return line
+	}
+	if !w.inSecret {
+		return line
+	}
+	if m := dataKeyPattern.FindStringSubmatch(body); m != nil {
+		w.inData = true
+		w.dataIndent = len(m[1])
+		return line
+	}
+	if !w.inData || trimmed == "" {
+		return line
+	}
+	indent := len(body) - len(strings.TrimLeft(body, " "))
+	if indent <= w.dataIndent {
+		w.inData = false
+		return line
+	}
+	if m := dataEntryPattern.FindStringSubmatch(body); m != nil {
+		if m[2] == "" || helmDiffMaskedPattern.MatchString(m[2]) {
+			return line
+		}
+		return prefix + m[1] + " " + Mask
+	}
+	return prefix + body[:indent] + Mask
+}
@@ -0,0 +1,162 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestString(t *testing.T) {
+	r := New()
+	r.Add("s3cr3t", "abc", "s3cr3t-token\nsecond line")
+	tests := map[string]struct {
+		in   string
+		want string
+	}{
+		"plain value": {
+			in:   "--kube-token=s3cr3t",
+			want: "--kube-token=***",
+		},
+		"longer value containing other value": {
+			in:   "token: s3cr3t-token",
+			want: "token: ***",
+		},
+		"line of multi-line value": {
+			in:   "second line",
+			want: "***",
+		},
+		"base64 encoded value": {
+			in:   "password: czNjcjN0",
+			want: "password: ***",
+		},
+		"short value is not registered": {
+			in:   "abc",
+			want: "abc",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, r.String(tc.in)); diff != "" {
+				t.Fatalf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *Redactor
+	r.Add("s3cr3t")
+	if got := r.String("s3cr3t"); got != "s3cr3t" {
+		t.Fatalf("want s3cr3t, got %s", got)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tests := map[string]struct {
+		in   []string
+		want string
+	}{
+		"registered value split across writes": {
+			in:   []string{"--dest-registry-token s3", "cr3t docker://a\n", "no newline"},
+			want: "--dest-registry-token *** docker://a\nno newline",
+		},
+		"helm-diff of secret": {
+			in: []string{`foo-dev, bar, Deployment (apps) has changed:
+  # Source: chart/templates/deployment.yaml
+  data:
+-   image: a
++   image: b
+foo-dev, bar, Secret (v1) has changed:
+  # Source: chart/templates/secret.yaml
+  apiVersion: v1
+  data:
+-   password: 'czNjcjN0'
++   password: 'b3RoZXI='
+    username: '-------- # (8 bytes)'
+  kind: Secret
+  metadata:
+    name: bar
+foo-dev, baz, ConfigMap (v1) has changed:
+  data:
+-   key: a
++   key: b
+`},
+			want: `foo-dev, bar, Deployment (apps) has changed:
+  # Source: chart/templates/deployment.yaml
+  data:
+-   image: a
++   image: b
+foo-dev, bar, Secret (v1) has changed:
+  # Source: chart/templates/secret.yaml
+  apiVersion: v1
+  data:
+-   password: ***
++   password: ***
+    username: '-------- # (8 bytes)'
+  kind: Secret
+  metadata:
+    name: bar
+foo-dev, baz, ConfigMap (v1) has changed:
+  data:
+-   key: a
++   key: b
+`,
+		},
+		"secret manifest": {
+			in: []string{`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+stringData:
+  cert: |
+    -----BEGIN CERTIFICATE-----
+    MIIB
+  password: other
+type: Opaque
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  password: visible
+`},
+			want: `---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+stringData:
+  cert: ***
+    ***
+    ***
+  password: ***
+type: Opaque
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  password: visible
+`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := New()
+			r.Add("s3cr3t")
+			var buf bytes.Buffer
+			w := r.Writer(&buf)
+			for _, in := range tc.in {
+				if _, err := w.Write([]byte(in)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, buf.String()); diff != "" {
+				t.Fatalf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+set -ue
+
+# This script mimicks "age-keygen -y <file>" by printing a fake recipient
+# for each identity found in the given file.
+# It can be used in tests which cannot rely on age-keygen being installed.
+
+n=0
+while read -r line; do
+  if [[ "$line" == AGE-SECRET-KEY-* ]]; then
+    n=$((n+1))
+    echo "age1fakerecipient${n}"
+  fi
+done < "$2"